@@ -1,24 +1,108 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/casbin/casbin"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-contrib/sse"
 
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/miluxas/ChatBackendGo/models"
 )
 
 func main() {
+	storeType := flag.String("store", "memory", "where chats are kept: memory or bolt")
+	dbPath := flag.String("db", "chat.db", "database file of the bolt store")
+	demoUsers := flag.Bool("demo-users", false, "create the demo accounts if they are not exist")
+	adminID := flag.String("admin", "", "id of a user that gets the admin role on start")
+	rolesPath := flag.String("roles", "authz_roles.csv", "file that roles granted at runtime are kept in")
+	blobDir := flag.String("blobs", "blobs", "directory that uploaded files are kept in")
+	flag.Parse()
+
+	blobStore, err := models.NewLocalBlobStore(*blobDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	models.SetBlobStore(blobStore)
+
+	switch *storeType {
+	case "memory":
+		models.SetChatStore(models.NewMemoryChatStore())
+		models.SetUserStore(models.NewMemoryUserStore())
+	case "bolt":
+		boltStore, err := models.OpenBoltStore(*dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer boltStore.Close()
+		if err := models.SetChatStore(boltStore); err != nil {
+			log.Fatal(err)
+		}
+		models.SetUserStore(boltStore)
+	default:
+		log.Fatalf("unknown store %q", *storeType)
+	}
+	if *demoUsers {
+		if err := models.CreateDemoUsers(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// load the casbin model and policy from files, database is also supported.
-	e, _ := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	// the policy file only has permissions of roles, roles of users are granted
+	// on start and at runtime and kept in the roles file.
+	e, err := casbin.NewSyncedEnforcer("authz_model.conf", "authz_policy.csv")
+	if err != nil {
+		log.Fatal(err)
+	}
+	roles, err := loadRoles(e, *rolesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	userIDs, err := models.GetUserIDs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range userIDs {
+		if err := roles.add(v, defaultRole); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// chat ids are the domains of the chat enforcer, roles of members are synced
+	// from the chat store so its policy file only has the role permissions.
+	ce, err := casbin.NewSyncedEnforcer("chat_model.conf", "chat_policy.csv")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := models.SetMembershipListener(newChatRoleSyncer(ce)); err != nil {
+		log.Fatal(err)
+	}
+	if *adminID != "" {
+		if _, err := models.GetUser(*adminID); err != nil {
+			log.Fatalf("admin %q: %v", *adminID, err)
+		}
+		if err := roles.add(*adminID, "admin"); err != nil {
+			log.Fatal(err)
+		}
+	}
 	router := gin.New()
 	store := cookie.NewStore([]byte("secret"))
 	router.Use(sessions.Sessions("mysession", store))
@@ -29,6 +113,7 @@ func main() {
 	// no authentication endpoints
 	{
 		api.POST("/login", loginHandler)
+		api.POST("/register", newRegisterHandler(roles))
 	}
 	// basic authentication endpoints
 	{
@@ -38,17 +123,48 @@ func main() {
 		basicAuth.Use(checkUserAuthentication())
 		{
 			basicAuth.GET("/logout", logoutHandler)
+			basicAuth.POST("/ChangePassword", changePasswordHandler)
+			basicAuth.POST("/DeleteAccount", newDeleteAccountHandler(roles))
+			basicAuth.POST("/GrantRole", newGrantRoleHandler(roles))
+			basicAuth.POST("/RevokeRole", newRevokeRoleHandler(roles))
+			basicAuth.POST("/GetRoles", newGetRolesHandler(e))
 			basicAuth.POST("/CreateNewChat", startNewPeerChat)
 			basicAuth.POST("/CreateGroupChat", startNewGroupChat)
-			basicAuth.POST("/SendMessageToChat", sendMessageToChat)
+			basicAuth.POST("/SendMessageToChat", newChatAuthorizer(ce, "post"), sendMessageToChat)
+			basicAuth.POST("/Upload", newBodyLimiter(models.MaxAttachmentSize+1<<20), newChatAuthorizer(ce, "post"), uploadAttachment)
+			basicAuth.GET("/Download", newChatAuthorizer(ce, "read"), downloadAttachment)
+			basicAuth.POST("/EditMessage", newChatAuthorizer(ce, "post"), editMessage)
+			basicAuth.POST("/DeleteMessage", newChatAuthorizer(ce, "read"), deleteMessage)
+			basicAuth.POST("/MarkRead", newChatAuthorizer(ce, "read"), markReadHandler)
+			basicAuth.POST("/Typing", newChatAuthorizer(ce, "post"), typing)
+			basicAuth.POST("/React", newChatAuthorizer(ce, "react"), newReactionHandler(models.React))
+			basicAuth.POST("/Unreact", newChatAuthorizer(ce, "react"), newReactionHandler(models.Unreact))
 			basicAuth.POST("/JoinToChat", joinToChat)
-			basicAuth.POST("/AddMemberToChat", addMemberToChat)
-			basicAuth.POST("/LeaveFromChat", leaveFromChat)
-			basicAuth.POST("/BlockChat", blockChat)
-			basicAuth.POST("/GetChat", getChat)
+			basicAuth.POST("/AddMemberToChat", newChatAuthorizer(ce, "addMember"), addMemberToChat)
+			basicAuth.POST("/GetJoinRequests", newChatAuthorizer(ce, "manage"), getJoinRequests)
+			basicAuth.POST("/ApproveJoin", newChatAuthorizer(ce, "manage"), newJoinDecisionHandler(models.ApproveJoin, "JoinApproved"))
+			basicAuth.POST("/RejectJoin", newChatAuthorizer(ce, "manage"), newJoinDecisionHandler(models.RejectJoin, "JoinRejected"))
+			basicAuth.POST("/CreateInvite", newChatAuthorizer(ce, "manage"), createInvite)
+			basicAuth.POST("/RevokeInvite", newChatAuthorizer(ce, "manage"), revokeInvite)
+			basicAuth.POST("/GetInvites", newChatAuthorizer(ce, "manage"), getInvites)
+			basicAuth.POST("/JoinByInvite", joinByInvite)
+			basicAuth.POST("/LeaveFromChat", newChatAuthorizer(ce, "leave"), leaveFromChat)
+			basicAuth.POST("/BlockChat", newChatAuthorizer(ce, "block"), blockChat)
+			basicAuth.POST("/UnblockChat", newChatAuthorizer(ce, "unblock"), unblockChat)
+			basicAuth.POST("/BlockUser", newUserBlockHandler(models.BlockUser, "user blocked successfully!"))
+			basicAuth.POST("/UnblockUser", newUserBlockHandler(models.UnblockUser, "user unblocked successfully!"))
+			basicAuth.POST("/GetBlockedUsers", getBlockedUsers)
+			basicAuth.POST("/GetChat", newChatAuthorizer(ce, "read"), getChat)
+			basicAuth.POST("/GetMessages", newChatAuthorizer(ce, "read"), getMessages)
+			basicAuth.POST("/GetThread", newChatAuthorizer(ce, "read"), getThread)
+			basicAuth.POST("/Search", search)
 			basicAuth.POST("/GetChatList", getChatList)
-			basicAuth.POST("/ChangeMemberStatus", changeMemberStatus)
+			basicAuth.POST("/ChangeMemberStatus", newChatAuthorizer(ce, "manage"), changeMemberStatus)
+			basicAuth.POST("/SetMemberRole", newChatAuthorizer(ce, "own"), setMemberRole)
+			basicAuth.POST("/TransferOwnership", newChatAuthorizer(ce, "own"), transferOwnership)
 			basicAuth.GET("/Stream", stream)
+			basicAuth.GET("/WS", newWebsocketHandler(ce))
+			basicAuth.POST("/Presence", getPresence)
 		}
 	}
 
@@ -69,11 +185,12 @@ func checkUserAuthentication(auths ...string) gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+		models.TouchPresence(fmt.Sprintf("%v", user))
 		c.Next()
 	}
 }
 
-func newAuthorizer(e *casbin.Enforcer) gin.HandlerFunc {
+func newAuthorizer(e *casbin.SyncedEnforcer) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if !checkPermission(c, e) {
 			requirePermission(c)
@@ -81,7 +198,7 @@ func newAuthorizer(e *casbin.Enforcer) gin.HandlerFunc {
 	}
 }
 
-func checkPermission(c *gin.Context, a *casbin.Enforcer) bool {
+func checkPermission(c *gin.Context, a *casbin.SyncedEnforcer) bool {
 	session := sessions.Default(c)
 	user := session.Get("user")
 	if user == nil {
@@ -92,7 +209,7 @@ func checkPermission(c *gin.Context, a *casbin.Enforcer) bool {
 	method := c.Request.Method
 	path := c.Request.URL.Path
 
-	allowed, err := a.Enforce(user, path, method)
+	allowed, err := a.Enforce(userSubject(fmt.Sprintf("%v", user)), path, method)
 	if err != nil {
 		panic(err)
 	}
@@ -104,6 +221,74 @@ func requirePermission(c *gin.Context) {
 	c.AbortWithStatus(403)
 }
 
+/********************************************************************************/
+/*	chat level permissions by the roles of members in each chat					*/
+/*																				*/
+/********************************************************************************/
+func newChatRoleSyncer(ce *casbin.SyncedEnforcer) models.MembershipListener {
+	return func(chatID, userID, role string) {
+		sub := userSubject(userID)
+		for _, r := range ce.GetRolesForUserInDomain(sub, chatID) {
+			if r == role {
+				return
+			}
+			if _, err := ce.DeleteRoleForUserInDomain(sub, r, chatID); err != nil {
+				log.Println(err)
+			}
+		}
+		if role == "" {
+			return
+		}
+		if _, err := ce.AddRoleForUserInDomain(sub, role, chatID); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func newChatAuthorizer(ce *casbin.SyncedEnforcer, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checkChatPermission(ce, getUserID(c), requestChatID(c), action) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "user has no " + action + " permission in this chat"})
+		}
+	}
+}
+
+func checkChatPermission(ce *casbin.SyncedEnforcer, userID, chatID, action string) bool {
+	allowed, err := ce.Enforce(userSubject(userID), chatID, action)
+	if err != nil {
+		panic(err)
+	}
+	return allowed
+}
+
+//requestChatID read chatId from query, form or body of request and put the
+//body back for the handler
+func requestChatID(c *gin.Context) string {
+	if chatID := c.Query("chatId"); chatID != "" {
+		return chatID
+	}
+	b, ok := binding.Default(c.Request.Method, c.ContentType()).(binding.BindingBody)
+	if !ok {
+		return c.PostForm("chatId")
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	req := struct {
+		ChatID string `json:"chatId" xml:"chatId"`
+	}{}
+	b.BindBody(body, &req)
+	return req.ChatID
+}
+
+func newBodyLimiter(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+}
+
 func getUserID(c *gin.Context) string {
 	session := sessions.Default(c)
 	return fmt.Sprintf("%v", session.Get("user"))
@@ -126,16 +311,17 @@ func loginHandler(c *gin.Context) {
 		return
 	}
 	session := sessions.Default(c)
-	userI := models.AuthenticateUser(user.Username, user.Password)
-
 	if strings.Trim(user.Username, " ") == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "username can't be empty"})
+		return
 	}
-	if userI.ID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid auth type"})
+	userI, err := models.AuthenticateUser(user.Username, user.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 	session.Set("user", userI.ID)
-	err := session.Save()
+	err = session.Save()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate session token"})
 		return
@@ -144,6 +330,98 @@ func loginHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "authentication successful", "usr": userI})
 }
 
+/********************************************************************************/
+/*	user registration 															*/
+/*																				*/
+/********************************************************************************/
+type registration struct {
+	ID        string `form:"id" json:"id" xml:"id" binding:"required"`
+	Username  string `form:"username" json:"username" xml:"username" binding:"required"`
+	Password  string `form:"password" json:"password" xml:"password" binding:"required"`
+	FirstName string `form:"firstName" json:"firstName" xml:"firstName"`
+	LastName  string `form:"lastName" json:"lastName" xml:"lastName"`
+}
+
+func newRegisterHandler(roles *roleFile) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		registerHandler(c, roles)
+	}
+}
+
+func registerHandler(c *gin.Context, roles *roleFile) {
+	registration := registration{}
+	if err := c.ShouldBind(&registration); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newUser, err := models.RegisterUser(registration.ID, registration.Username, registration.Password,
+		registration.FirstName, registration.LastName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := roles.add(newUser.ID, defaultRole); err != nil {
+		models.UnregisterUser(newUser.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to assign role: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "user registered successfully!", "usr": newUser})
+}
+
+/********************************************************************************/
+/*	change password and delete account											*/
+/*																				*/
+/********************************************************************************/
+type passwordChange struct {
+	OldPassword string `form:"oldPassword" json:"oldPassword" xml:"oldPassword" binding:"required"`
+	NewPassword string `form:"newPassword" json:"newPassword" xml:"newPassword" binding:"required"`
+}
+
+func changePasswordHandler(c *gin.Context) {
+	passwordChange := passwordChange{}
+	if err := c.ShouldBind(&passwordChange); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.ChangePassword(getUserID(c), passwordChange.OldPassword, passwordChange.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password changed successfully!"})
+}
+
+type accountDeletion struct {
+	Password string `form:"password" json:"password" xml:"password" binding:"required"`
+}
+
+func newDeleteAccountHandler(roles *roleFile) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deleteAccountHandler(c, roles)
+	}
+}
+
+func deleteAccountHandler(c *gin.Context, roles *roleFile) {
+	accountDeletion := accountDeletion{}
+	if err := c.ShouldBind(&accountDeletion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.DeleteUser(getUserID(c), accountDeletion.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := roles.removeUser(getUserID(c)); err != nil {
+		log.Println(err)
+	}
+	session := sessions.Default(c)
+	session.Delete("user")
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate session token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "account deleted successfully!"})
+}
+
 /********************************************************************************/
 /*	user logout 																*/
 /*																				*/
@@ -162,6 +440,197 @@ func logoutHandler(c *gin.Context) {
 
 }
 
+/********************************************************************************/
+/*	role management 															*/
+/*																				*/
+/********************************************************************************/
+const defaultRole = "user"
+
+// users are casbin subjects with this prefix so a user id never matches a role
+const userSubjectPrefix = "user:"
+
+func userSubject(userID string) string {
+	return userSubjectPrefix + userID
+}
+
+// roles that can be granted through the api
+var grantableRoles = map[string]bool{
+	"user":      true,
+	"moderator": true,
+	"admin":     true,
+}
+
+//roleFile give roles to users in the enforcer and keep the granted roles in a
+//file, every account gets the default role on start so it is not kept. The
+//tracked policy file is never written.
+type roleFile struct {
+	lock    sync.Mutex
+	e       *casbin.SyncedEnforcer
+	path    string
+	granted map[string]map[string]bool
+}
+
+//loadRoles give the roles of the file at path to users, the file is created on
+//the first grant
+func loadRoles(e *casbin.SyncedEnforcer, path string) (*roleFile, error) {
+	r := &roleFile{e: e, path: path, granted: make(map[string]map[string]bool)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for ind, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) != 3 || fields[0] != "g" || !strings.HasPrefix(fields[1], userSubjectPrefix) {
+			return nil, fmt.Errorf("%s:%d: want g, %s<id>, <role>", path, ind+1, userSubjectPrefix)
+		}
+		userID := strings.TrimPrefix(fields[1], userSubjectPrefix)
+		if _, err := e.AddRoleForUser(fields[1], fields[2]); err != nil {
+			return nil, err
+		}
+		if r.granted[userID] == nil {
+			r.granted[userID] = make(map[string]bool)
+		}
+		r.granted[userID][fields[2]] = true
+	}
+	return r, nil
+}
+
+//save write the granted roles to a new file and replace the old one with it
+func (r *roleFile) save() error {
+	var lines []string
+	for userID, roles := range r.granted {
+		for role := range roles {
+			lines = append(lines, fmt.Sprintf("g, %s, %s\n", userSubject(userID), role))
+		}
+	}
+	sort.Strings(lines)
+	tmpPath := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+func (r *roleFile) add(userID, role string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.e.AddRoleForUser(userSubject(userID), role); err != nil {
+		return err
+	}
+	if role == defaultRole || r.granted[userID][role] {
+		return nil
+	}
+	if r.granted[userID] == nil {
+		r.granted[userID] = make(map[string]bool)
+	}
+	r.granted[userID][role] = true
+	return r.save()
+}
+
+//remove take a role from user and return false when user doesn't have it
+func (r *roleFile) remove(userID, role string) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	removed, err := r.e.DeleteRoleForUser(userSubject(userID), role)
+	if err != nil || !r.granted[userID][role] {
+		return removed, err
+	}
+	delete(r.granted[userID], role)
+	return removed, r.save()
+}
+
+//removeUser take all roles from a deleted user
+func (r *roleFile) removeUser(userID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.e.DeleteUser(userSubject(userID)); err != nil {
+		return err
+	}
+	if r.granted[userID] == nil {
+		return nil
+	}
+	delete(r.granted, userID)
+	return r.save()
+}
+
+type roleChange struct {
+	UserID string `form:"userId" json:"userId" xml:"userId" binding:"required"`
+	Role   string `form:"role" json:"role" xml:"role"`
+}
+
+func newGrantRoleHandler(roles *roleFile) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roleChange := roleChange{}
+		if err := c.ShouldBind(&roleChange); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !grantableRoles[roleChange.Role] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role"})
+			return
+		}
+		if _, err := models.GetUser(roleChange.UserID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := roles.add(roleChange.UserID, roleChange.Role); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "role granted successfully!"})
+	}
+}
+
+func newRevokeRoleHandler(roles *roleFile) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roleChange := roleChange{}
+		if err := c.ShouldBind(&roleChange); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if roleChange.UserID == getUserID(c) && roleChange.Role == "admin" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "admins can't revoke their own admin role"})
+			return
+		}
+		removed, err := roles.remove(roleChange.UserID, roleChange.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !removed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user doesn't have this role"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "role revoked successfully!"})
+	}
+}
+
+func newGetRolesHandler(e *casbin.SyncedEnforcer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roleChange := roleChange{}
+		if err := c.ShouldBind(&roleChange); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		roles, err := e.GetRolesForUser(userSubject(roleChange.UserID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"userId": roleChange.UserID, "roles": roles})
+	}
+}
+
 /********************************************************************************/
 /*	start new peer chat															*/
 /*																				*/
@@ -215,7 +684,11 @@ func startNewGroupChat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	newChatID := models.StartNewGroupChat(newGroupChat.Title, getUserID(c), newGroupChat.ChatType)
+	newChatID, err := models.StartNewGroupChat(newGroupChat.Title, getUserID(c), newGroupChat.ChatType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	newGroupChat.ID = newChatID
 	newAlert := models.Alert{
 		AlertType: "NewChatCreated",
@@ -231,11 +704,33 @@ func startNewGroupChat(c *gin.Context) {
 /*																				*/
 /********************************************************************************/
 type newMessage struct {
-	ChatID   string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
-	Message  string `form:"message" json:"Content" xml:"message" binding:"required"`
-	OwnerID  string
-	ID       string
-	CreateAt time.Time
+	ChatID        string   `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	Message       string   `form:"message" json:"Content" xml:"message"`
+	ReplyToID     string   `form:"replyToId" json:"replyToId" xml:"replyToId"`
+	AttachmentIDs []string `form:"attachmentIds" json:"attachmentIds" xml:"attachmentIds"`
+	OwnerID       string
+	ID            string
+	CreateAt      time.Time
+	Attachments   []models.Attachment
+}
+
+//postMessage add the message to its chat and alert the chat members
+func postMessage(userID string, newMessage newMessage) (newMessage, error) {
+	createAt, newID, attachments, err := models.SendMessageToChat(newMessage.ChatID, userID, newMessage.Message,
+		newMessage.ReplyToID, newMessage.AttachmentIDs)
+	if err != nil {
+		return newMessage, err
+	}
+	newMessage.OwnerID = userID
+	newMessage.ID = newID
+	newMessage.CreateAt = createAt
+	newMessage.Attachments = attachments
+	newAlert := models.Alert{
+		AlertType: "NewMessageAdded",
+		Data:      newMessage,
+	}
+	models.SendAlertToMember(newMessage.ChatID, newAlert)
+	return newMessage, nil
 }
 
 func sendMessageToChat(c *gin.Context) {
@@ -244,17 +739,9 @@ func sendMessageToChat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	createAt, newID, err := models.SendMessageToChat(newMessage.ChatID, getUserID(c), newMessage.Message)
-	newMessage.OwnerID = getUserID(c)
-	newMessage.ID = newID
-	newMessage.CreateAt = createAt
+	newMessage, err := postMessage(getUserID(c), newMessage)
 	if err == nil {
-		newAlert := models.Alert{
-			AlertType: "NewMessageAdded",
-			Data:      newMessage,
-		}
-		models.SendAlertToMember(newMessage.ChatID, newAlert)
-		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Message created successfully!", "newId": newID})
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Message created successfully!", "newId": newMessage.ID})
 		return
 	}
 
@@ -264,30 +751,30 @@ func sendMessageToChat(c *gin.Context) {
 }
 
 /********************************************************************************/
-/*	join to a chat																*/
+/*	upload and download attachments												*/
 /*																				*/
 /********************************************************************************/
-type chat struct {
-	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
-	MemberID  string `form:"memberID" json:"memberID" xml:"memberID"`
-	OwnerID   string
-	NewStatus string `form:"newStatus" json:"newStatus" xml:"newStatus"`
+type uploadedFile struct {
+	ChatID string                `form:"chatId" binding:"required"`
+	File   *multipart.FileHeader `form:"file" binding:"required"`
 }
 
-func joinToChat(c *gin.Context) {
-	chat := chat{}
-	if err := c.ShouldBind(&chat); err != nil {
+func uploadAttachment(c *gin.Context) {
+	uploadedFile := uploadedFile{}
+	if err := c.ShouldBind(&uploadedFile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := uploadedFile.File.Open()
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	newID, err := models.JoinToChat(chat.ChatID, getUserID(c))
+	defer f.Close()
+	attachment, err := models.UploadAttachment(uploadedFile.ChatID, getUserID(c), uploadedFile.File.Filename,
+		uploadedFile.File.Size, f)
 	if err == nil {
-		newAlert := models.Alert{
-			AlertType: "JoinedToChat",
-			Data:      chat,
-		}
-		models.SendAlertToMember(chat.ChatID, newAlert)
-		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "joined to chat successfully!", "newId": newID})
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "File uploaded successfully!", "attachment": attachment})
 		return
 	}
 
@@ -296,35 +783,427 @@ func joinToChat(c *gin.Context) {
 	}
 }
 
+type downloadQuery struct {
+	ChatID       string `form:"chatId" binding:"required"`
+	AttachmentID string `form:"attachmentId" binding:"required"`
+	Thumbnail    bool   `form:"thumbnail"`
+}
+
+func downloadAttachment(c *gin.Context) {
+	downloadQuery := downloadQuery{}
+	if err := c.ShouldBindQuery(&downloadQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	attachment, r, err := models.OpenAttachment(downloadQuery.ChatID, getUserID(c), downloadQuery.AttachmentID,
+		downloadQuery.Thumbnail)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+		return
+	}
+	defer r.Close()
+	size, mimeType := attachment.Size, attachment.MIMEType
+	if downloadQuery.Thumbnail {
+		size, mimeType = attachment.ThumbnailSize, attachment.ThumbnailMIMEType
+	}
+	c.DataFromReader(http.StatusOK, size, mimeType, r, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
+
 /********************************************************************************/
-/*	add a new member to a chat													*/
+/*	edit a message																*/
 /*																				*/
 /********************************************************************************/
-type member struct {
-	ChatID       string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
-	UserID       string `form:"userId" json:"UserID" xml:"userId" binding:"required"`
-	Title        string
-	MemberStatus string
-	ID           string
+type editedMessage struct {
+	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MessageID string `form:"messageId" json:"messageId" xml:"messageId" binding:"required"`
+	Message   string `form:"message" json:"Content" xml:"message" binding:"required"`
+	EditedAt  time.Time
 }
 
-func addMemberToChat(c *gin.Context) {
-	member := member{}
-	if err := c.ShouldBind(&member); err != nil {
+func editMessage(c *gin.Context) {
+	editedMessage := editedMessage{}
+	if err := c.ShouldBind(&editedMessage); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	title, newID, err := models.AddOtherUserToChat(member.ChatID, getUserID(c), member.UserID)
+	mes, err := models.EditMessage(editedMessage.ChatID, getUserID(c), editedMessage.MessageID, editedMessage.Message)
 	if err == nil {
-		member.Title = title
-		member.MemberStatus = "MemberStatusNormal"
-		member.ID = newID
+		if mes.EditedAt != nil {
+			editedMessage.EditedAt = *mes.EditedAt
+		}
 		newAlert := models.Alert{
-			AlertType: "AddedToChat",
-			Data:      member,
+			AlertType: "MessageEdited",
+			Data:      editedMessage,
 		}
-		models.SendAlertToOneMember(member.UserID, newAlert)
-
+		models.SendAlertToMember(editedMessage.ChatID, newAlert)
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Message edited successfully!"})
+		return
+	}
+
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	delete a message for current user or for everyone							*/
+/*																				*/
+/********************************************************************************/
+type deletedMessage struct {
+	ChatID      string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MessageID   string `form:"messageId" json:"messageId" xml:"messageId" binding:"required"`
+	ForEveryone bool   `form:"forEveryone" json:"forEveryone" xml:"forEveryone"`
+}
+
+func deleteMessage(c *gin.Context) {
+	deletedMessage := deletedMessage{}
+	if err := c.ShouldBind(&deletedMessage); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := models.DeleteMessage(deletedMessage.ChatID, getUserID(c), deletedMessage.MessageID, deletedMessage.ForEveryone)
+	if err == nil {
+		newAlert := models.Alert{
+			AlertType: "MessageDeleted",
+			Data:      deletedMessage,
+		}
+		if deletedMessage.ForEveryone {
+			models.SendAlertToMember(deletedMessage.ChatID, newAlert)
+		} else {
+			// other tabs of the user
+			models.SendAlertToOneMember(getUserID(c), newAlert)
+		}
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Message deleted successfully!"})
+		return
+	}
+
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	mark messages of a chat as read												*/
+/*																				*/
+/********************************************************************************/
+type readMessage struct {
+	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MessageID string `form:"messageId" json:"messageId" xml:"messageId" binding:"required"`
+	UserID    string
+}
+
+//markRead mark messages as read and alert chat members so senders can show it
+func markRead(userID string, readMessage readMessage) error {
+	changed, err := models.MarkRead(readMessage.ChatID, userID, readMessage.MessageID)
+	if err != nil || !changed {
+		return err
+	}
+	readMessage.UserID = userID
+	newAlert := models.Alert{
+		AlertType: "MessagesRead",
+		Data:      readMessage,
+	}
+	models.SendAlertToMember(readMessage.ChatID, newAlert)
+	return nil
+}
+
+func markReadHandler(c *gin.Context) {
+	readMessage := readMessage{}
+	if err := c.ShouldBind(&readMessage); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := markRead(getUserID(c), readMessage)
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Messages marked as read!"})
+		return
+	}
+
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	add or remove a reaction to a message										*/
+/*																				*/
+/********************************************************************************/
+type messageReaction struct {
+	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MessageID string `form:"messageId" json:"messageId" xml:"messageId" binding:"required"`
+	Emoji     string `form:"emoji" json:"emoji" xml:"emoji" binding:"required"`
+	UserID    string
+	Reactions []models.Reaction
+}
+
+func newReactionHandler(change func(chatID, userID, messageID, emoji string) ([]models.Reaction, bool, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		messageReaction := messageReaction{}
+		if err := c.ShouldBind(&messageReaction); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		reactions, changed, err := change(messageReaction.ChatID, getUserID(c), messageReaction.MessageID, messageReaction.Emoji)
+		if err == nil {
+			if changed {
+				messageReaction.UserID = getUserID(c)
+				messageReaction.Reactions = reactions
+				newAlert := models.Alert{
+					AlertType: "ReactionChanged",
+					Data:      messageReaction,
+				}
+				models.SendAlertToMember(messageReaction.ChatID, newAlert)
+			}
+			c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Reaction saved successfully!", "reactions": reactions})
+			return
+		}
+
+		{
+			c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+		}
+	}
+}
+
+/********************************************************************************/
+/*	tell other members that user is typing										*/
+/*																				*/
+/********************************************************************************/
+type typingSignal struct {
+	ChatID string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	Stop   bool   `form:"stop" json:"stop" xml:"stop"`
+}
+
+func typing(c *gin.Context) {
+	typingSignal := typingSignal{}
+	if err := c.ShouldBind(&typingSignal); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if typingSignal.Stop {
+		models.StopTyping(typingSignal.ChatID, getUserID(c))
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK})
+		return
+	}
+	err := models.SendTyping(typingSignal.ChatID, getUserID(c))
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{"status": http.StatusOK})
+		return
+	}
+
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	join to a chat																*/
+/*																				*/
+/********************************************************************************/
+type chat struct {
+	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MemberID  string `form:"memberID" json:"memberID" xml:"memberID"`
+	OwnerID   string
+	NewStatus string `form:"newStatus" json:"newStatus" xml:"newStatus"`
+}
+
+func joinToChat(c *gin.Context) {
+	chat := chat{}
+	if err := c.ShouldBind(&chat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newID, memberStatus, err := models.JoinToChat(chat.ChatID, getUserID(c))
+	if err == nil && memberStatus == models.MemberStatusRequested {
+		chat.MemberID = newID
+		chat.OwnerID = getUserID(c)
+		newAlert := models.Alert{
+			AlertType: "JoinRequested",
+			Data:      chat,
+		}
+		models.SendAlertToManagers(chat.ChatID, newAlert)
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "join request sent successfully!", "newId": newID})
+		return
+	}
+	if err == nil {
+		newAlert := models.Alert{
+			AlertType: "JoinedToChat",
+			Data:      chat,
+		}
+		models.SendAlertToMember(chat.ChatID, newAlert)
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "joined to chat successfully!", "newId": newID})
+		return
+	}
+
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	list, approve and reject join requests of private chats						*/
+/*																				*/
+/********************************************************************************/
+func getJoinRequests(c *gin.Context) {
+	chat := chat{}
+	if err := c.ShouldBind(&chat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	jRequests, err := models.GetJoinRequests(chat.ChatID, getUserID(c))
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "join requests get successfully!", "jRequests": jRequests})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+func newJoinDecisionHandler(decide func(chatID, currentUserID, memberID string) (string, error), alertType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chat := chat{}
+		if err := c.ShouldBind(&chat); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, err := decide(chat.ChatID, getUserID(c), chat.MemberID)
+		if err == nil {
+			chat.OwnerID = getUserID(c)
+			newAlert := models.Alert{
+				AlertType: alertType,
+				Data:      chat,
+			}
+			models.SendAlertToOneMember(userID, newAlert)
+			if alertType == "JoinApproved" {
+				newAlert.AlertType = "JoinedToChat"
+				models.SendAlertToOtherMembers(chat.ChatID, userID, newAlert)
+			}
+			c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "join request answered successfully!"})
+			return
+		}
+		{
+			c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+		}
+	}
+}
+
+/********************************************************************************/
+/*	invite links of group chats													*/
+/*																				*/
+/********************************************************************************/
+type newInvite struct {
+	ChatID string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	// ExpiresIn is in seconds, zero means the invite never expires
+	ExpiresIn int `form:"expiresIn" json:"expiresIn" xml:"expiresIn"`
+	MaxUses   int `form:"maxUses" json:"maxUses" xml:"maxUses"`
+}
+
+func createInvite(c *gin.Context) {
+	newInvite := newInvite{}
+	if err := c.ShouldBind(&newInvite); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	invite, err := models.CreateInvite(newInvite.ChatID, getUserID(c), time.Duration(newInvite.ExpiresIn)*time.Second, newInvite.MaxUses)
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "invite created successfully!", "invite": invite})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+type inviteToken struct {
+	ChatID string `form:"chatId" json:"chatId" xml:"chatId"`
+	Token  string `form:"token" json:"token" xml:"token" binding:"required"`
+}
+
+func revokeInvite(c *gin.Context) {
+	inviteToken := inviteToken{}
+	if err := c.ShouldBind(&inviteToken); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := models.RevokeInvite(inviteToken.ChatID, getUserID(c), inviteToken.Token)
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "invite revoked successfully!"})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+func getInvites(c *gin.Context) {
+	chat := chat{}
+	if err := c.ShouldBind(&chat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	jInvites, err := models.GetInvites(chat.ChatID, getUserID(c))
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "invites get successfully!", "jInvites": jInvites})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+func joinByInvite(c *gin.Context) {
+	inviteToken := inviteToken{}
+	if err := c.ShouldBind(&inviteToken); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	chatID, newID, err := models.JoinByInvite(getUserID(c), inviteToken.Token)
+	if err == nil {
+		newAlert := models.Alert{
+			AlertType: "JoinedToChat",
+			Data:      chat{ChatID: chatID, MemberID: newID, OwnerID: getUserID(c)},
+		}
+		models.SendAlertToMember(chatID, newAlert)
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "joined to chat successfully!", "chatId": chatID, "newId": newID})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	add a new member to a chat													*/
+/*																				*/
+/********************************************************************************/
+type member struct {
+	ChatID       string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	UserID       string `form:"userId" json:"UserID" xml:"userId" binding:"required"`
+	Title        string
+	MemberStatus string
+	ID           string
+}
+
+func addMemberToChat(c *gin.Context) {
+	member := member{}
+	if err := c.ShouldBind(&member); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	title, newID, err := models.AddOtherUserToChat(member.ChatID, getUserID(c), member.UserID)
+	if err == nil {
+		member.Title = title
+		member.MemberStatus = "MemberStatusNormal"
+		member.ID = newID
+		newAlert := models.Alert{
+			AlertType: "AddedToChat",
+			Data:      member,
+		}
+		models.SendAlertToOneMember(member.UserID, newAlert)
+
 		newAlert.AlertType = "NewMemberAdded"
 		models.SendAlertToMember(member.ChatID, newAlert)
 
@@ -343,7 +1222,7 @@ func leaveFromChat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	leftUserID, leftMemberID, err := models.LeaveChat(chat.ChatID, getUserID(c))
+	leftUserID, leftMemberID, handOver, err := models.LeaveChat(chat.ChatID, getUserID(c))
 	if err == nil {
 		chat.MemberID = leftMemberID
 		newAlert := models.Alert{
@@ -353,6 +1232,9 @@ func leaveFromChat(c *gin.Context) {
 		models.SendAlertToMember(chat.ChatID, newAlert)
 		newAlert.AlertType = "LeftChat"
 		models.SendAlertToOneMember(leftUserID, newAlert)
+		if handOver != nil {
+			sendRoleChanges(*handOver)
+		}
 
 		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "member left chat successfully!"})
 		return
@@ -388,6 +1270,65 @@ func blockChat(c *gin.Context) {
 	}
 }
 
+/********************************************************************************/
+/*	unblock peer chats and block list of the user								*/
+/*																				*/
+/********************************************************************************/
+func unblockChat(c *gin.Context) {
+	chat := chat{}
+	if err := c.ShouldBind(&chat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	unblockedUserID, unblockedMemberID, err := models.UnblockChat(chat.ChatID, getUserID(c))
+	if err == nil {
+		chat.MemberID = unblockedMemberID
+		chat.OwnerID = getUserID(c)
+		newAlert := models.Alert{
+			AlertType: "Unblocked",
+			Data:      chat,
+		}
+		models.SendAlertToOneMember(unblockedUserID, newAlert)
+
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "chat unblocked successfully!"})
+		return
+	}
+
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+type blockedUser struct {
+	UserID string `form:"userId" json:"userId" xml:"userId" binding:"required"`
+}
+
+func newUserBlockHandler(change func(currentUserID, userID string) error, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		blockedUser := blockedUser{}
+		if err := c.ShouldBind(&blockedUser); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := change(getUserID(c), blockedUser.UserID); err != nil {
+			c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": message})
+	}
+}
+
+func getBlockedUsers(c *gin.Context) {
+	users, err := models.GetBlockedUsers(getUserID(c))
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "blocked users get successfully!", "users": users})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
 func changeMemberStatus(c *gin.Context) {
 	chat := chat{}
 	if err := c.ShouldBind(&chat); err != nil {
@@ -414,6 +1355,60 @@ func changeMemberStatus(c *gin.Context) {
 	}
 }
 
+/********************************************************************************/
+/*	change roles of members and owner of a chat									*/
+/*																				*/
+/********************************************************************************/
+type memberRole struct {
+	ChatID     string            `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MemberID   string            `form:"memberID" json:"memberID" xml:"memberID" binding:"required"`
+	MemberType models.MemberType `form:"memberType" json:"memberType" xml:"memberType"`
+}
+
+func setMemberRole(c *gin.Context) {
+	memberRole := memberRole{}
+	if err := c.ShouldBind(&memberRole); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	change, err := models.SetMemberRole(memberRole.ChatID, getUserID(c), memberRole.MemberID, memberRole.MemberType)
+	if err == nil {
+		sendRoleChanges(change)
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "member role changed successfully!"})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+func transferOwnership(c *gin.Context) {
+	chat := chat{}
+	if err := c.ShouldBind(&chat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	changes, err := models.TransferOwnership(chat.ChatID, getUserID(c), chat.MemberID)
+	if err == nil {
+		sendRoleChanges(changes...)
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "ownership transferred successfully!"})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+func sendRoleChanges(changes ...models.RoleChange) {
+	for _, change := range changes {
+		newAlert := models.Alert{
+			AlertType: "MemberRoleChanged",
+			Data:      change,
+		}
+		models.SendAlertToMember(change.ChatID, newAlert)
+	}
+}
+
 /********************************************************************************/
 /*	get the chat as a json string												*/
 /*																				*/
@@ -434,6 +1429,84 @@ func getChat(c *gin.Context) {
 	}
 }
 
+/********************************************************************************/
+/*	get a page of chat messages as a json string								*/
+/*																				*/
+/********************************************************************************/
+type messagePage struct {
+	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	Cursor    string `form:"cursor" json:"cursor" xml:"cursor"`
+	Direction string `form:"direction" json:"direction" xml:"direction"`
+	Limit     int    `form:"limit" json:"limit" xml:"limit"`
+}
+
+func getMessages(c *gin.Context) {
+	page := messagePage{}
+	if err := c.ShouldBind(&page); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	jMessages, err := models.GetMessages(page.ChatID, getUserID(c), page.Cursor, page.Direction, page.Limit)
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Messages loaded successfully!", "jMessages": jMessages})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	get the replies of a message as a json string								*/
+/*																				*/
+/********************************************************************************/
+type threadQuery struct {
+	ChatID    string `form:"chatId" json:"chatId" xml:"chatId" binding:"required"`
+	MessageID string `form:"messageId" json:"messageId" xml:"messageId" binding:"required"`
+}
+
+func getThread(c *gin.Context) {
+	threadQuery := threadQuery{}
+	if err := c.ShouldBind(&threadQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	jThread, err := models.GetThread(threadQuery.ChatID, getUserID(c), threadQuery.MessageID)
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Thread loaded successfully!", "jThread": jThread})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
+/********************************************************************************/
+/*	search messages of the user chats											*/
+/*																				*/
+/********************************************************************************/
+type searchQuery struct {
+	Query  string `form:"query" json:"query" xml:"query" binding:"required"`
+	Offset int    `form:"offset" json:"offset" xml:"offset"`
+	Limit  int    `form:"limit" json:"limit" xml:"limit"`
+}
+
+func search(c *gin.Context) {
+	searchQuery := searchQuery{}
+	if err := c.ShouldBind(&searchQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	jResults, err := models.Search(getUserID(c), searchQuery.Query, searchQuery.Offset, searchQuery.Limit)
+	if err == nil {
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusCreated, "message": "Search done successfully!", "jResults": jResults})
+		return
+	}
+	{
+		c.JSON(http.StatusCreated, gin.H{"status": http.StatusNotFound, "message": err.Error()})
+	}
+}
+
 /********************************************************************************/
 /*	get the user chat list as a json string										*/
 /*																				*/
@@ -449,26 +1522,74 @@ func getChatList(c *gin.Context) {
 	}
 }
 
+/********************************************************************************/
+/*	get online status of users													*/
+/*																				*/
+/********************************************************************************/
+type presenceQuery struct {
+	UserIDs []string `form:"userIds" json:"userIds" xml:"userIds" binding:"required"`
+}
+
+func getPresence(c *gin.Context) {
+	presenceQuery := presenceQuery{}
+	if err := c.ShouldBind(&presenceQuery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": http.StatusOK, "presence": models.GetPresence(getUserID(c), presenceQuery.UserIDs)})
+}
+
 /********************************************************************************/
 /*	get the realtime stream 													*/
 /*																				*/
 /********************************************************************************/
 func stream(c *gin.Context) {
 	userID := getUserID(c)
-	listener := models.OpenListener(userID)
+	// EventSource send the ID of the last received event when it reconnect
+	lastEventID, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+	listener, missed := models.OpenListenerFrom(userID, lastEventID)
 	defer models.CloseListener(userID, listener)
+	userDeleted := models.ListenerDone(userID)
 
 	clientGone := c.Writer.CloseNotify()
 
 	c.Stream(func(w io.Writer) bool {
+		if len(missed) > 0 {
+			sendEvent(c, missed[0])
+			if missed[0].ID > lastEventID {
+				lastEventID = missed[0].ID
+			}
+			missed = missed[1:]
+			return true
+		}
 		select {
 		case <-clientGone:
 			return false
+		case <-userDeleted:
+			return false
 		case mes := <-listener:
 			//fmt.Println(mes)
 			alert := mes.(models.Alert)
-			c.SSEvent(alert.AlertType, alert.Data)
+			if alert.ID != 0 {
+				if alert.ID <= lastEventID {
+					// already replayed
+					return true
+				}
+				lastEventID = alert.ID
+			}
+			sendEvent(c, alert)
 			return true
 		}
 	})
 }
+
+func sendEvent(c *gin.Context, alert models.Alert) {
+	event := sse.Event{
+		Event: alert.AlertType,
+		Data:  alert.Data,
+	}
+	if alert.ID != 0 {
+		event.Id = strconv.FormatUint(alert.ID, 10)
+	}
+	c.Render(-1, event)
+}
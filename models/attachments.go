@@ -0,0 +1,180 @@
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+//MaxAttachmentSize is the biggest file that can be uploaded
+const MaxAttachmentSize = 10 << 20
+
+//allowedMIMETypes are the sniffed content types that can be uploaded
+var allowedMIMETypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+}
+
+//Attachment a file uploaded to a chat
+type Attachment struct {
+	ID        string
+	OwnerID   string
+	MessageID string
+	FileName  string
+	MIMEType  string
+	Size      int64
+	BlobHash  string
+	CreateAt  time.Time
+	// Width and Height are set for images
+	Width  int
+	Height int
+	// thumbnail of images, ThumbnailHash is empty for other files
+	ThumbnailHash     string
+	ThumbnailMIMEType string
+	ThumbnailSize     int64
+	ThumbnailWidth    int
+	ThumbnailHeight   int
+}
+
+func (ch *chat) findAttachment(attachmentID string) (int, error) {
+	for ind, v := range ch.Attachments {
+		if v.ID == attachmentID {
+			return ind, nil
+		}
+	}
+	return -1, fmt.Errorf("Attachment didnt find")
+}
+
+//UploadAttachment store a file for current user in a chat, it can be sent later with a message
+func UploadAttachment(chatID, currentUserID, fileName string, size int64, r io.Reader) (Attachment, error) {
+	if blobStore == nil {
+		return Attachment{}, fmt.Errorf("attachments are not enabled")
+	}
+	if size > MaxAttachmentSize {
+		return Attachment{}, fmt.Errorf("file is bigger than %d bytes", MaxAttachmentSize)
+	}
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if err := authorize(chat, currentUserID, ActionPost); err != nil {
+		return Attachment{}, err
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil || !allowedMIMETypes[mimeType] {
+		return Attachment{}, fmt.Errorf("file type is not allowed")
+	}
+	hash, storedSize, err := blobStore.Put(io.LimitReader(br, MaxAttachmentSize))
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	newAttachment := Attachment{
+		ID:       createUniqID(),
+		OwnerID:  currentUserID,
+		FileName: filepath.Base(fileName),
+		MIMEType: mimeType,
+		Size:     storedSize,
+		BlobHash: hash,
+		CreateAt: time.Now(),
+	}
+	if thumbnailMIMETypes[mimeType] {
+		// images that are too big or can not be decoded are kept as plain files
+		// without a thumbnail, their size is set when the header can be read
+		addImageInfo(&newAttachment)
+	}
+
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err = getChatInfoFromID(chatID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	chat.Attachments = append(chat.Attachments, newAttachment)
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return Attachment{}, err
+	}
+	return newAttachment, nil
+}
+
+//attach link uploaded attachments of current user to a new message
+func (ch *chat) attach(newMes *message, attachmentIDs []string) ([]Attachment, error) {
+	var attachments []Attachment
+	for _, id := range attachmentIDs {
+		ind, err := ch.findAttachment(id)
+		if err != nil {
+			return nil, err
+		}
+		att := &ch.Attachments[ind]
+		if att.OwnerID != newMes.OwnerID {
+			return nil, fmt.Errorf("attachment is uploaded by another user")
+		}
+		if att.MessageID != "" {
+			return nil, fmt.Errorf("attachment is already sent")
+		}
+		att.MessageID = newMes.ID
+		newMes.AttachmentIDs = append(newMes.AttachmentIDs, id)
+		attachments = append(attachments, *att)
+	}
+	return attachments, nil
+}
+
+//removeAttachments remove attachments from chat, their blobs stay in the blob store
+//because other attachments may have the same content
+func (ch *chat) removeAttachments(attachmentIDs []string) {
+	for _, id := range attachmentIDs {
+		if ind, err := ch.findAttachment(id); err == nil {
+			ch.Attachments = append(ch.Attachments[:ind], ch.Attachments[ind+1:]...)
+		}
+	}
+}
+
+//OpenAttachment open content or thumbnail of an attachment of a chat that current user is member of
+func OpenAttachment(chatID, currentUserID, attachmentID string, thumbnail bool) (Attachment, io.ReadCloser, error) {
+	if blobStore == nil {
+		return Attachment{}, nil, fmt.Errorf("attachments are not enabled")
+	}
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	if err := authorize(chat, currentUserID, ActionRead); err != nil {
+		return Attachment{}, nil, err
+	}
+	ind, err := chat.findAttachment(attachmentID)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	att := chat.Attachments[ind]
+	if att.MessageID == "" && att.OwnerID != currentUserID {
+		return Attachment{}, nil, fmt.Errorf("Attachment didnt find")
+	}
+	hash := att.BlobHash
+	if thumbnail {
+		if att.ThumbnailHash == "" {
+			return Attachment{}, nil, fmt.Errorf("attachment has no thumbnail")
+		}
+		hash = att.ThumbnailHash
+	}
+	r, err := blobStore.Open(hash)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	return att, r, nil
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//BlobStore keep file contents addressed by the sha256 hash of content
+type BlobStore interface {
+	Put(r io.Reader) (string, int64, error)
+	Open(hash string) (io.ReadCloser, error)
+}
+
+var blobStore BlobStore
+
+//SetBlobStore set the store that attachments are written to
+func SetBlobStore(store BlobStore) {
+	blobStore = store
+}
+
+/********************************************************************/
+/*					blob store on local disk						*/
+/*																	*/
+/********************************************************************/
+type localBlobStore struct {
+	dir string
+}
+
+//NewLocalBlobStore return a blob store that keep files under dir
+func NewLocalBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func isBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (s *localBlobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *localBlobStore) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.dir, "upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	p := s.path(hash)
+	if _, err := os.Stat(p); err == nil {
+		// same content is already stored
+		return hash, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+func (s *localBlobStore) Open(hash string) (io.ReadCloser, error) {
+	if !isBlobHash(hash) {
+		return nil, fmt.Errorf("invalid blob hash")
+	}
+	return os.Open(s.path(hash))
+}
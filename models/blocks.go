@@ -0,0 +1,187 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// blockLock keep read-modify-write of block lists of accounts in order
+var blockLock sync.Mutex
+
+//isBlockedBy check blocker has user in its block list
+func isBlockedBy(userID, blockerID string) bool {
+	acc, err := userStore.GetAccount(blockerID)
+	if err != nil {
+		return false
+	}
+	for _, v := range acc.BlockedUserIDs {
+		if v == userID {
+			return true
+		}
+	}
+	return false
+}
+
+//checkNotBlocked return an error if one of the two users blocked the other
+func checkNotBlocked(currentUserID, userID string) error {
+	if isBlockedBy(currentUserID, userID) {
+		return ErrBlockedByUser
+	}
+	if isBlockedBy(userID, currentUserID) {
+		return ErrUserBlocked
+	}
+	return nil
+}
+
+//setBlocked add user to or remove it from block list of current user
+func setBlocked(currentUserID, userID string, blocked bool) error {
+	blockLock.Lock()
+	defer blockLock.Unlock()
+	acc, err := userStore.GetAccount(currentUserID)
+	if err != nil {
+		return err
+	}
+	blockedUserIDs := make([]string, 0, len(acc.BlockedUserIDs)+1)
+	isBlocked := false
+	for _, v := range acc.BlockedUserIDs {
+		if v == userID {
+			isBlocked = true
+		} else {
+			blockedUserIDs = append(blockedUserIDs, v)
+		}
+	}
+	if isBlocked == blocked {
+		if blocked {
+			return fmt.Errorf("user is blocked already")
+		}
+		return fmt.Errorf("user is not blocked")
+	}
+	if blocked {
+		blockedUserIDs = append(blockedUserIDs, userID)
+	}
+	acc.BlockedUserIDs = blockedUserIDs
+	return userStore.SaveAccount(acc)
+}
+
+//peerOf return the other member of a peer chat
+func (ch *chat) peerOf(userID string) *member {
+	for ind, v := range ch.MemberList {
+		if v.UserID != userID {
+			return &ch.MemberList[ind]
+		}
+	}
+	return nil
+}
+
+//findPeerChat return id of the peer chat of two users or empty string
+func findPeerChat(userID, otherUserID string) (string, error) {
+	return chatStore.PeerChatID(userID, otherUserID)
+}
+
+//setPeerStatus change status of the other member of a peer chat between
+//blocked and normal, it return the other member and if its status changed
+func setPeerStatus(chatID, currentUserID, memberStatus string) (member, bool, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return member{}, false, err
+	}
+	if err := authorize(chat, currentUserID, ActionUnblock); err != nil {
+		return member{}, false, err
+	}
+	peer := chat.peerOf(currentUserID)
+	if peer == nil {
+		return member{}, false, fmt.Errorf("Member didnt find")
+	}
+	from := MemberStatusNormal
+	if memberStatus == MemberStatusNormal {
+		from = MemberStatusBlocked
+	}
+	if peer.MemberStatus != from {
+		return *peer, false, nil
+	}
+	peer.MemberStatus = memberStatus
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return member{}, false, err
+	}
+	chat.membershipChanged(peer.UserID)
+	return *peer, true, nil
+}
+
+//BlockUser block a user for current user, the user can not start a peer chat
+//with, add or message current user any more
+func BlockUser(currentUserID, userID string) error {
+	if currentUserID == userID {
+		return fmt.Errorf("can not block yourself")
+	}
+	if _, err := GetUser(userID); err != nil {
+		return err
+	}
+	if err := setBlocked(currentUserID, userID, true); err != nil {
+		return err
+	}
+	chatID, err := findPeerChat(currentUserID, userID)
+	if err != nil || chatID == "" {
+		return err
+	}
+	_, _, err = setPeerStatus(chatID, currentUserID, MemberStatusBlocked)
+	return ignoreLeftPeerChat(err)
+}
+
+//ignoreLeftPeerChat ignore the permission error of a peer chat that user left,
+//the block list is changed and there is no chat status to change
+func ignoreLeftPeerChat(err error) error {
+	var permErr *PermissionError
+	if errors.As(err, &permErr) && permErr.Err == ErrNotMember {
+		return nil
+	}
+	return err
+}
+
+//UnblockUser remove a user from block list of current user and unblock the
+//peer chat of them
+func UnblockUser(currentUserID, userID string) error {
+	if err := setBlocked(currentUserID, userID, false); err != nil {
+		return err
+	}
+	chatID, err := findPeerChat(currentUserID, userID)
+	if err != nil || chatID == "" {
+		return err
+	}
+	_, _, err = setPeerStatus(chatID, currentUserID, MemberStatusNormal)
+	return ignoreLeftPeerChat(err)
+}
+
+//UnblockChat unblock the other member of a peer chat and return its user id
+//and member id
+func UnblockChat(chatID, currentUserID string) (string, string, error) {
+	peer, changed, err := setPeerStatus(chatID, currentUserID, MemberStatusNormal)
+	if err != nil {
+		return "", "", err
+	}
+	// chats blocked before block lists have no block list entry
+	if err := setBlocked(currentUserID, peer.UserID, false); err != nil && !changed {
+		return "", "", err
+	}
+	return peer.UserID, peer.ID, nil
+}
+
+//GetBlockedUsers return the users that current user blocked
+func GetBlockedUsers(currentUserID string) ([]User, error) {
+	acc, err := userStore.GetAccount(currentUserID)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(acc.BlockedUserIDs))
+	for _, v := range acc.BlockedUserIDs {
+		blockedUser, err := GetUser(v)
+		if err != nil {
+			// account of user is deleted
+			blockedUser = User{ID: v}
+		}
+		users = append(users, blockedUser)
+	}
+	return users, nil
+}
@@ -0,0 +1,499 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	chatBucket     = []byte("chats")
+	userBucket     = []byte("users")
+	usernameBucket = []byte("usernames")
+	// messageBucket has a bucket for each chat with messages keyed by their order
+	messageBucket = []byte("messages")
+	// messageIDBucket has a bucket for each chat with the order of message IDs
+	messageIDBucket = []byte("messageIDs")
+	// userChatBucket has a bucket for each user with ids of chats of user
+	userChatBucket   = []byte("userChats")
+	peerChatBucket   = []byte("peerChats")
+	inviteChatBucket = []byte("inviteChats")
+)
+
+//BoltStore keep chats and user accounts in an embedded bolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+//OpenBoltStore open or create the bolt database at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// files of older versions keep messages inside chats and have no indexes
+		isOld := tx.Bucket(chatBucket) != nil && tx.Bucket(messageBucket) == nil
+		for _, name := range [][]byte{chatBucket, userBucket, usernameBucket, messageBucket,
+			messageIDBucket, userChatBucket, peerChatBucket, inviteChatBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if isOld {
+			return migrateChats(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+//Close close the database file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+//migrateChats move messages out of the chats and build the indexes
+func migrateChats(tx *bolt.Tx) error {
+	var chatList []chat
+	err := tx.Bucket(chatBucket).ForEach(func(k, v []byte) error {
+		var ch chat
+		if err := json.Unmarshal(v, &ch); err != nil {
+			return err
+		}
+		chatList = append(chatList, ch)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ch := range chatList {
+		if err := putChat(tx, chat{}, ch); err != nil {
+			return err
+		}
+		for _, v := range ch.MessageList {
+			if err := addMessage(tx, ch.ID, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getChat(tx *bolt.Tx, chatID string) (chat, error) {
+	var ch chat
+	jChat := tx.Bucket(chatBucket).Get([]byte(chatID))
+	if jChat == nil {
+		return ch, fmt.Errorf("Chat didnt find")
+	}
+	err := json.Unmarshal(jChat, &ch)
+	return ch, err
+}
+
+//putChat save ch without its messages and update the indexes from old
+func putChat(tx *bolt.Tx, old, ch chat) error {
+	ch.MessageList = nil
+	jChat, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(chatBucket).Put([]byte(ch.ID), jChat); err != nil {
+		return err
+	}
+
+	userChats := tx.Bucket(userChatBucket)
+	for _, v := range removedKeys(chatUserIDs(old), chatUserIDs(ch)) {
+		if b := userChats.Bucket([]byte(v)); b != nil {
+			if err := b.Delete([]byte(ch.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range chatUserIDs(ch) {
+		b, err := userChats.CreateBucketIfNotExists([]byte(v))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(ch.ID), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	inviteChats := tx.Bucket(inviteChatBucket)
+	for _, v := range removedKeys(inviteTokens(old), inviteTokens(ch)) {
+		if err := inviteChats.Delete([]byte(v)); err != nil {
+			return err
+		}
+	}
+	for _, v := range inviteTokens(ch) {
+		if err := inviteChats.Put([]byte(v), []byte(ch.ID)); err != nil {
+			return err
+		}
+	}
+
+	if key, ok := peerChatKey(ch); ok {
+		return tx.Bucket(peerChatBucket).Put([]byte(key), []byte(ch.ID))
+	}
+	return nil
+}
+
+func addMessage(tx *bolt.Tx, chatID string, newMessage message) error {
+	messages, err := tx.Bucket(messageBucket).CreateBucketIfNotExists([]byte(chatID))
+	if err != nil {
+		return err
+	}
+	messageIDs, err := tx.Bucket(messageIDBucket).CreateBucketIfNotExists([]byte(chatID))
+	if err != nil {
+		return err
+	}
+	if messageIDs.Get([]byte(newMessage.ID)) != nil {
+		return fmt.Errorf("Message is exist")
+	}
+	seq, err := messages.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	if err := messageIDs.Put([]byte(newMessage.ID), key); err != nil {
+		return err
+	}
+	return putMessage(messages, key, newMessage)
+}
+
+func putMessage(messages *bolt.Bucket, key []byte, mes message) error {
+	jMessage, err := json.Marshal(mes)
+	if err != nil {
+		return err
+	}
+	return messages.Put(key, jMessage)
+}
+
+//messageKey return the bucket of messages of chat and the key of a message in it
+func messageKey(tx *bolt.Tx, chatID, messageID string) (*bolt.Bucket, []byte, error) {
+	messages := tx.Bucket(messageBucket).Bucket([]byte(chatID))
+	messageIDs := tx.Bucket(messageIDBucket).Bucket([]byte(chatID))
+	if messages == nil || messageIDs == nil {
+		return nil, nil, fmt.Errorf("Message didnt find")
+	}
+	key := messageIDs.Get([]byte(messageID))
+	if key == nil {
+		return nil, nil, fmt.Errorf("Message didnt find")
+	}
+	return messages, key, nil
+}
+
+//AddChat add a new chat
+func (s *BoltStore) AddChat(newChat chat) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(chatBucket).Get([]byte(newChat.ID)) != nil {
+			return fmt.Errorf("Chat is exist")
+		}
+		if err := putChat(tx, chat{}, newChat); err != nil {
+			return err
+		}
+		for _, v := range newChat.MessageList {
+			if err := addMessage(tx, newChat.ID, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//GetChat load a chat with its messages
+func (s *BoltStore) GetChat(chatID string) (chat, error) {
+	var ch chat
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ch, err = getChat(tx, chatID)
+		if err != nil {
+			return err
+		}
+		ch.MessageList = []message{}
+		messages := tx.Bucket(messageBucket).Bucket([]byte(chatID))
+		if messages == nil {
+			return nil
+		}
+		return messages.ForEach(func(k, v []byte) error {
+			var mes message
+			if err := json.Unmarshal(v, &mes); err != nil {
+				return err
+			}
+			ch.MessageList = append(ch.MessageList, mes)
+			return nil
+		})
+	})
+	return ch, err
+}
+
+//GetChatInfo load a chat without its messages
+func (s *BoltStore) GetChatInfo(chatID string) (chat, error) {
+	var ch chat
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ch, err = getChat(tx, chatID)
+		return err
+	})
+	return ch, err
+}
+
+//SaveChat replace a stored chat, messages are saved with SaveMessage
+func (s *BoltStore) SaveChat(ch chat) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := getChat(tx, ch.ID)
+		if err != nil {
+			return err
+		}
+		return putChat(tx, old, ch)
+	})
+}
+
+//AddMessage add a message to the end of a chat
+func (s *BoltStore) AddMessage(chatID string, newMessage message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(chatBucket).Get([]byte(chatID)) == nil {
+			return fmt.Errorf("Chat didnt find")
+		}
+		return addMessage(tx, chatID, newMessage)
+	})
+}
+
+//GetMessage load a message of a chat
+func (s *BoltStore) GetMessage(chatID, messageID string) (message, error) {
+	var mes message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		messages, key, err := messageKey(tx, chatID, messageID)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(messages.Get(key), &mes)
+	})
+	return mes, err
+}
+
+//SaveMessage replace a stored message
+func (s *BoltStore) SaveMessage(chatID string, mes message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		messages, key, err := messageKey(tx, chatID, mes.ID)
+		if err != nil {
+			return err
+		}
+		return putMessage(messages, key, mes)
+	})
+}
+
+//ChatsOfUser load the chats that user is in member list of without messages
+func (s *BoltStore) ChatsOfUser(userID string) ([]chat, error) {
+	var list []chat
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(userChatBucket).Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ch, err := getChat(tx, string(k))
+			if err != nil {
+				return err
+			}
+			list = append(list, ch)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortChats(list)
+	return list, nil
+}
+
+//PeerChatID return id of the peer chat of two users or empty string
+func (s *BoltStore) PeerChatID(userID, otherUserID string) (string, error) {
+	var chatID string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		chatID = string(tx.Bucket(peerChatBucket).Get([]byte(peerKey(userID, otherUserID))))
+		return nil
+	})
+	return chatID, err
+}
+
+//InviteChatID return id of the chat that has the invite token or empty string
+func (s *BoltStore) InviteChatID(token string) (string, error) {
+	var chatID string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		chatID = string(tx.Bucket(inviteChatBucket).Get([]byte(token)))
+		return nil
+	})
+	return chatID, err
+}
+
+//AllChats load all chats without messages ordered by create time
+func (s *BoltStore) AllChats() ([]chat, error) {
+	var list []chat
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(chatBucket).ForEach(func(k, v []byte) error {
+			var ch chat
+			if err := json.Unmarshal(v, &ch); err != nil {
+				return err
+			}
+			list = append(list, ch)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortChats(list)
+	return list, nil
+}
+
+func putAccount(b *bolt.Bucket, acc account) error {
+	jAccount, err := json.Marshal(acc)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(acc.ID), jAccount)
+}
+
+func getAccount(b *bolt.Bucket, userID string) (account, error) {
+	var acc account
+	jAccount := b.Get([]byte(userID))
+	if jAccount == nil {
+		return acc, fmt.Errorf("User didnt find")
+	}
+	if err := json.Unmarshal(jAccount, &acc); err != nil {
+		return acc, err
+	}
+	if acc.DeletedAt != nil {
+		return account{}, fmt.Errorf("User didnt find")
+	}
+	return acc, nil
+}
+
+//AddAccount add a new account
+func (s *BoltStore) AddAccount(newAccount account) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(userBucket)
+		usernames := tx.Bucket(usernameBucket)
+		if users.Get([]byte(newAccount.ID)) != nil {
+			return fmt.Errorf("user id is taken")
+		}
+		if usernames.Get([]byte(newAccount.Username)) != nil {
+			return fmt.Errorf("username is taken")
+		}
+		if err := usernames.Put([]byte(newAccount.Username), []byte(newAccount.ID)); err != nil {
+			return err
+		}
+		return putAccount(users, newAccount)
+	})
+}
+
+//GetAccount load an account
+func (s *BoltStore) GetAccount(userID string) (account, error) {
+	var acc account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		acc, err = getAccount(tx.Bucket(userBucket), userID)
+		return err
+	})
+	return acc, err
+}
+
+//GetAccountByUsername load an account by its username
+func (s *BoltStore) GetAccountByUsername(username string) (account, error) {
+	var acc account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		userID := tx.Bucket(usernameBucket).Get([]byte(username))
+		if userID == nil {
+			return fmt.Errorf("User didnt find")
+		}
+		var err error
+		acc, err = getAccount(tx.Bucket(userBucket), string(userID))
+		return err
+	})
+	return acc, err
+}
+
+//SaveAccount replace a stored account
+func (s *BoltStore) SaveAccount(acc account) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(userBucket)
+		usernames := tx.Bucket(usernameBucket)
+		old, err := getAccount(users, acc.ID)
+		if err != nil {
+			return err
+		}
+		if acc.Username != old.Username {
+			if usernames.Get([]byte(acc.Username)) != nil {
+				return fmt.Errorf("username is taken")
+			}
+			if err := usernames.Delete([]byte(old.Username)); err != nil {
+				return err
+			}
+			if err := usernames.Put([]byte(acc.Username), []byte(acc.ID)); err != nil {
+				return err
+			}
+		}
+		return putAccount(users, acc)
+	})
+}
+
+//DeleteAccount replace an account with a tombstone that keep its id reserved
+func (s *BoltStore) DeleteAccount(userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(userBucket)
+		acc, err := getAccount(users, userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(usernameBucket).Delete([]byte(acc.Username)); err != nil {
+			return err
+		}
+		return putAccount(users, deletedAccount(userID))
+	})
+}
+
+//PurgeAccount remove an account and its tombstone so its id is free again
+func (s *BoltStore) PurgeAccount(userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(userBucket)
+		jAccount := users.Get([]byte(userID))
+		if jAccount == nil {
+			return fmt.Errorf("User didnt find")
+		}
+		var acc account
+		if err := json.Unmarshal(jAccount, &acc); err != nil {
+			return err
+		}
+		if acc.DeletedAt == nil {
+			if err := tx.Bucket(usernameBucket).Delete([]byte(acc.Username)); err != nil {
+				return err
+			}
+		}
+		return users.Delete([]byte(userID))
+	})
+}
+
+//AccountIDs return ids of all accounts that are not deleted
+func (s *BoltStore) AccountIDs() ([]string, error) {
+	var userIDs []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// deleted accounts have no username
+		return tx.Bucket(usernameBucket).ForEach(func(k, v []byte) error {
+			userIDs = append(userIDs, string(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
@@ -0,0 +1,20 @@
+package models
+
+func (ch *chat) isChannel() bool {
+	return ch.ChatType == ChatTypePublicCannal || ch.ChatType == ChatTypePrivateCannal
+}
+
+//subscriberCount return number of normal members of a channel and zero for
+//other chat types
+func (ch *chat) subscriberCount() int {
+	if !ch.isChannel() {
+		return 0
+	}
+	count := 0
+	for _, v := range ch.MemberList {
+		if v.MemberStatus == MemberStatusNormal {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,82 @@
+package models
+
+const (
+	// ChatRoleOwner role of the owner of a group or channel
+	ChatRoleOwner = "owner"
+	// ChatRoleAdmin role of admins of a group or channel
+	ChatRoleAdmin = "admin"
+	// ChatRoleMember role of normal members of a group
+	ChatRoleMember = "member"
+	// ChatRoleSubscriber role of normal members of a channel
+	ChatRoleSubscriber = "subscriber"
+	// ChatRolePeer role of the two members of a peer chat
+	ChatRolePeer = "peer"
+	// ChatRoleRequested role of users that requested to join
+	ChatRoleRequested = "requested"
+	// ChatRoleBlocked role of the blocked member of a peer chat
+	ChatRoleBlocked = "blocked"
+)
+
+//chatRole return the role of a member in chat by chat type and member type
+//and status, it is empty when member has no right in chat
+func (ch *chat) chatRole(mem member) string {
+	switch mem.MemberStatus {
+	case MemberStatusNormal:
+	case MemberStatusRequested:
+		return ChatRoleRequested
+	case MemberStatusBlocked:
+		if ch.ChatType == ChatTypePeer {
+			return ChatRoleBlocked
+		}
+		return ""
+	default:
+		return ""
+	}
+	switch {
+	case ch.ChatType == ChatTypePeer:
+		return ChatRolePeer
+	case mem.MemberType == MemberTypeOwner:
+		return ChatRoleOwner
+	case mem.MemberType == MemberTypeAamin:
+		return ChatRoleAdmin
+	case ch.isChannel():
+		return ChatRoleSubscriber
+	}
+	return ChatRoleMember
+}
+
+//MembershipListener is called with the new role of a user in a chat when the
+//membership of user changes, role is empty when user has no role any more
+type MembershipListener func(chatID, userID, role string)
+
+var membershipListener MembershipListener
+
+//SetMembershipListener set the listener of membership changes and call it for
+//every member of the chats in store
+func SetMembershipListener(listener MembershipListener) error {
+	membershipListener = listener
+	chatList, err := chatStore.AllChats()
+	if err != nil {
+		return err
+	}
+	for _, ch := range chatList {
+		for _, v := range ch.MemberList {
+			listener(ch.ID, v.UserID, ch.chatRole(v))
+		}
+	}
+	return nil
+}
+
+//membershipChanged tell the listener the current role of users in chat
+func (ch *chat) membershipChanged(userIDs ...string) {
+	if membershipListener == nil {
+		return
+	}
+	for _, userID := range userIDs {
+		role := ""
+		if mem := ch.getMember(userID); mem != nil {
+			role = ch.chatRole(*mem)
+		}
+		membershipListener(ch.ID, userID, role)
+	}
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type invite struct {
+	Token     string
+	CreatedBy string
+	CreateAt  time.Time
+	// ExpiresAt is nil for invites that never expire
+	ExpiresAt *time.Time
+	// MaxUses is zero for invites without usage limit
+	MaxUses   int
+	Uses      int
+	RevokedAt *time.Time
+}
+
+func (inv invite) clone() invite {
+	if inv.ExpiresAt != nil {
+		expiresAt := *inv.ExpiresAt
+		inv.ExpiresAt = &expiresAt
+	}
+	if inv.RevokedAt != nil {
+		revokedAt := *inv.RevokedAt
+		inv.RevokedAt = &revokedAt
+	}
+	return inv
+}
+
+//valid return an error if invite can not be used any more
+func (inv *invite) valid(now time.Time) error {
+	if inv.RevokedAt != nil {
+		return fmt.Errorf("invite is revoked")
+	}
+	if inv.ExpiresAt != nil && now.After(*inv.ExpiresAt) {
+		return fmt.Errorf("invite is expired")
+	}
+	if inv.MaxUses > 0 && inv.Uses >= inv.MaxUses {
+		return fmt.Errorf("invite is used up")
+	}
+	return nil
+}
+
+func (ch *chat) findInvite(token string) *invite {
+	for ind, v := range ch.Invites {
+		if v.Token == token {
+			return &ch.Invites[ind]
+		}
+	}
+	return nil
+}
+
+//CreateInvite make a new invite token for chat, zero expiresIn or maxUses
+//means no limit
+func CreateInvite(chatID, currentUserID string, expiresIn time.Duration, maxUses int) (invite, error) {
+	if expiresIn < 0 || maxUses < 0 {
+		return invite{}, fmt.Errorf("invalid invite limits")
+	}
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return invite{}, err
+	}
+	if err := authorize(chat, currentUserID, ActionManage); err != nil {
+		return invite{}, err
+	}
+	newInvite := invite{
+		Token:     createUniqID(),
+		CreatedBy: currentUserID,
+		CreateAt:  time.Now(),
+		MaxUses:   maxUses,
+	}
+	if expiresIn > 0 {
+		expiresAt := newInvite.CreateAt.Add(expiresIn)
+		newInvite.ExpiresAt = &expiresAt
+	}
+	chat.Invites = append(chat.Invites, newInvite)
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return invite{}, err
+	}
+	return newInvite.clone(), nil
+}
+
+//RevokeInvite stop an invite token from being used
+func RevokeInvite(chatID, currentUserID, token string) error {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return err
+	}
+	if err := authorize(chat, currentUserID, ActionManage); err != nil {
+		return err
+	}
+	inv := chat.findInvite(token)
+	if inv == nil {
+		return fmt.Errorf("Invite didnt find")
+	}
+	if inv.RevokedAt != nil {
+		return fmt.Errorf("invite is revoked")
+	}
+	revokedAt := time.Now()
+	inv.RevokedAt = &revokedAt
+	return chatStore.SaveChat(*chat)
+}
+
+//GetInvites return the invites of chat as a json string
+func GetInvites(chatID, currentUserID string) (string, error) {
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return "", err
+	}
+	if err := authorize(chat, currentUserID, ActionManage); err != nil {
+		return "", err
+	}
+	invites := chat.Invites
+	if invites == nil {
+		invites = []invite{}
+	}
+	jInvites, err := json.Marshal(invites)
+	if err != nil {
+		return "", err
+	}
+	return string(jInvites), nil
+}
+
+//findInviteChat return id of the chat that has the invite token
+func findInviteChat(token string) (string, error) {
+	chatID, err := chatStore.InviteChatID(token)
+	if err != nil {
+		return "", err
+	}
+	if chatID == "" {
+		return "", fmt.Errorf("Invite didnt find")
+	}
+	return chatID, nil
+}
+
+//JoinByInvite add current user as a normal member of the invite chat and
+//return the chat id and the member id
+func JoinByInvite(currentUserID, token string) (string, string, error) {
+	chatID, err := findInviteChat(token)
+	if err != nil {
+		return "", "", err
+	}
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return "", "", err
+	}
+	inv := chat.findInvite(token)
+	if inv == nil {
+		return "", "", fmt.Errorf("Invite didnt find")
+	}
+	if err := inv.valid(time.Now()); err != nil {
+		return "", "", err
+	}
+
+	// an invite also accept a pending join request of user
+	if mem := chat.getMember(currentUserID); mem == nil || mem.MemberStatus != MemberStatusRequested {
+		if err := authorize(chat, currentUserID, ActionJoin); err != nil {
+			return "", "", err
+		}
+	}
+	memberID := chat.admit(currentUserID, MemberStatusNormal)
+	inv.Uses++
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return "", "", err
+	}
+	chat.membershipChanged(currentUserID)
+	return chatID, memberID, nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type joinRequest struct {
+	MemberID    string
+	UserID      string
+	RequestedAt time.Time
+}
+
+//GetJoinRequests return the pending join requests of a chat as a json string
+func GetJoinRequests(chatID, currentUserID string) (string, error) {
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return "", err
+	}
+	if err := authorize(chat, currentUserID, ActionManage); err != nil {
+		return "", err
+	}
+	requests := []joinRequest{}
+	for _, v := range chat.MemberList {
+		if v.MemberStatus == MemberStatusRequested {
+			requests = append(requests, joinRequest{v.ID, v.UserID, v.AddedAt})
+		}
+	}
+	jRequests, err := json.Marshal(requests)
+	if err != nil {
+		return "", err
+	}
+	return string(jRequests), nil
+}
+
+//decideJoin find a pending request by member id and approve or remove it
+func decideJoin(chatID, currentUserID, memberID string, approve bool) (string, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return "", err
+	}
+	if err := authorize(chat, currentUserID, ActionManage); err != nil {
+		return "", err
+	}
+	for ind, v := range chat.MemberList {
+		if v.ID != memberID {
+			continue
+		}
+		if v.MemberStatus != MemberStatusRequested {
+			return "", fmt.Errorf("member has no pending join request")
+		}
+		if approve {
+			chat.MemberList[ind].MemberStatus = MemberStatusNormal
+			chat.MemberList[ind].AddedAt = time.Now()
+		} else {
+			chat.MemberList = append(chat.MemberList[:ind], chat.MemberList[ind+1:]...)
+		}
+		if err := chatStore.SaveChat(*chat); err != nil {
+			return "", err
+		}
+		chat.membershipChanged(v.UserID)
+		return v.UserID, nil
+	}
+	return "", fmt.Errorf("Member didnt find")
+}
+
+//ApproveJoin make a requested member a normal member and return its user id
+func ApproveJoin(chatID, currentUserID, memberID string) (string, error) {
+	return decideJoin(chatID, currentUserID, memberID, true)
+}
+
+//RejectJoin remove a requested member from chat and return its user id
+func RejectJoin(chatID, currentUserID, memberID string) (string, error) {
+	return decideJoin(chatID, currentUserID, memberID, false)
+}
+
+//SendAlertToManagers send alert to the owner and admins of chat
+func SendAlertToManagers(chatID string, newAlert Alert) {
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return
+	}
+	for _, v := range chat.MemberList {
+		if chat.isManager(v.UserID) {
+			getUserChannel(v.UserID).submit(newAlert)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-broadcast"
@@ -48,46 +50,6 @@ const (
 	MemberStatusExpeled string = "MemberStatusExpeled"
 )
 
-// ChatList list of all chat
-var ChatList []chat
-var users = []User{User{
-	ID:        "admin@e.c",
-	FirstName: "admin",
-	LastName:  "admini",
-	username:  "admin",
-	password:  "admin",
-}, User{
-	ID:        "normal@e.c",
-	FirstName: "normalUser",
-	LastName:  "lastNormal",
-	username:  "normal",
-	password:  "normal",
-}, User{
-	ID:        "kalim@e.c",
-	FirstName: "karim",
-	LastName:  "Aq Mangool",
-	username:  "kalim",
-	password:  "kalim",
-}, User{
-	ID:        "solivan@e.c",
-	FirstName: "solivan",
-	LastName:  "sol",
-	username:  "solivan",
-	password:  "solivan",
-}, User{
-	ID:        "zohre@e.c",
-	FirstName: "zohre",
-	LastName:  "zoh",
-	username:  "zohre",
-	password:  "zohre",
-}, User{
-	ID:        "ferzin@e.c",
-	FirstName: "ferzin",
-	LastName:  "feriiii",
-	username:  "ferzin",
-	password:  "ferzin",
-}}
-
 type chat struct {
 	ID          string
 	Title       string
@@ -95,6 +57,8 @@ type chat struct {
 	ChatType    string
 	MemberList  []member
 	MessageList []message
+	Attachments []Attachment
+	Invites     []invite
 }
 
 func (ch *chat) addMember(newMem *member) {
@@ -114,6 +78,75 @@ func (ch *chat) addMember(newMem *member) {
 	}
 }
 
+//admit make user a normal type member of chat with the status, the member of
+//a user that left or requested before is reused, it return the member id
+func (ch *chat) admit(userID, memberStatus string) string {
+	if mem := ch.getMember(userID); mem != nil {
+		mem.MemberType = MemberTypeNormal
+		mem.MemberStatus = memberStatus
+		mem.AddedAt = time.Now()
+		return mem.ID
+	}
+	newMember := member{
+		ID:           createUniqID(),
+		UserID:       userID,
+		AddedAt:      time.Now(),
+		MemberType:   MemberTypeNormal,
+		MemberStatus: memberStatus,
+	}
+	ch.MemberList = append(ch.MemberList, newMember)
+	return newMember.ID
+}
+
+func (ch chat) clone() chat {
+	ch.MemberList = append([]member(nil), ch.MemberList...)
+	messageList := make([]message, 0, len(ch.MessageList))
+	for _, v := range ch.MessageList {
+		messageList = append(messageList, v.clone())
+	}
+	ch.MessageList = messageList
+	ch.Attachments = append([]Attachment(nil), ch.Attachments...)
+	invites := make([]invite, 0, len(ch.Invites))
+	for _, v := range ch.Invites {
+		invites = append(invites, v.clone())
+	}
+	ch.Invites = invites
+	return ch
+}
+
+//getMember return member of user in chat or nil
+func (ch *chat) getMember(userID string) *member {
+	for ind, v := range ch.MemberList {
+		if v.UserID == userID {
+			return &ch.MemberList[ind]
+		}
+	}
+	return nil
+}
+
+//viewFor remove messages that user deleted only for own view, attachments
+//that other users are not sent yet and invites if user is not a manager
+func (ch *chat) viewFor(userID string) {
+	if !ch.isManager(userID) {
+		ch.Invites = nil
+	}
+	messageList := make([]message, 0, len(ch.MessageList))
+	for _, v := range ch.MessageList {
+		if !v.isHiddenFor(userID) {
+			v.HiddenFor = nil
+			messageList = append(messageList, v)
+		}
+	}
+	ch.MessageList = messageList
+	attachments := make([]Attachment, 0, len(ch.Attachments))
+	for _, v := range ch.Attachments {
+		if v.MessageID != "" || v.OwnerID == userID {
+			attachments = append(attachments, v)
+		}
+	}
+	ch.Attachments = attachments
+}
+
 func (ch *chat) findMember(userID string) bool {
 	for _, v := range ch.MemberList {
 		if v.UserID == userID && v.MemberStatus == MemberStatusNormal {
@@ -129,6 +162,47 @@ type message struct {
 	Content  string
 	CreateAt time.Time
 	OwnerID  string
+	EditedAt *time.Time
+	History  []messageVersion
+	// ReplyToID is the message that this message reply to
+	ReplyToID string
+	// ThreadID is the first message of the reply chain
+	ThreadID string
+	// ReplyCount is count of messages in the thread of a root message that are
+	// not deleted for everyone
+	ReplyCount int
+	// DeletedAt is set when the message is deleted for everyone
+	DeletedAt *time.Time
+	// HiddenFor user IDs that deleted the message only for themselves
+	HiddenFor     []string
+	Reactions     []Reaction
+	AttachmentIDs []string
+}
+
+//Reaction users that reacted to a message with an emoji
+type Reaction struct {
+	Emoji   string
+	Count   int
+	UserIDs []string
+}
+
+//messageVersion a content of message before it is edited
+type messageVersion struct {
+	Content  string
+	CreateAt time.Time
+}
+
+func (m message) clone() message {
+	m.History = append([]messageVersion(nil), m.History...)
+	m.HiddenFor = append([]string(nil), m.HiddenFor...)
+	m.AttachmentIDs = append([]string(nil), m.AttachmentIDs...)
+	reactions := make([]Reaction, 0, len(m.Reactions))
+	for _, v := range m.Reactions {
+		v.UserIDs = append([]string(nil), v.UserIDs...)
+		reactions = append(reactions, v)
+	}
+	m.Reactions = reactions
+	return m
 }
 
 type member struct {
@@ -137,19 +211,13 @@ type member struct {
 	AddedAt      time.Time
 	MemberType   MemberType
 	MemberStatus string
-}
-
-//User user of the chat system
-type User struct {
-	ID        string
-	FirstName string
-	LastName  string
-	username  string
-	password  string
+	// LastReadMessageID last message that member has read
+	LastReadMessageID string
 }
 
 //Alert alert for realtime
 type Alert struct {
+	ID        uint64
 	AlertType string
 	Data      interface{}
 }
@@ -169,35 +237,60 @@ func createUniqID() string {
 	return hex.EncodeToString(u)
 }
 
+//peerChatLock keep two peer chats of the same users from being created together
+var peerChatLock sync.Mutex
+
+//chatLocks is a fixed set of locks that chats share by hash of their id, so
+//there is no lock to clean up for each chat
+var chatLocks [256]sync.Mutex
+
+//lockChat lock a chat for a read-modify-write and return the unlock function,
+//a chat lock must not be taken while another one is held
+func lockChat(chatID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(chatID))
+	l := &chatLocks[h.Sum32()%uint32(len(chatLocks))]
+	l.Lock()
+	return l.Unlock
+}
+
 func getChatFromID(chatID string) (*chat, error) {
-	for ind, v := range ChatList {
-		if v.ID == chatID {
-			return &ChatList[ind], nil
-		}
+	ch, err := chatStore.GetChat(chatID)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Chat didnt find")
+	return &ch, nil
 }
 
-//AuthenticateUser authenticate user
-func AuthenticateUser(username, password string) User {
-	for _, usr := range users {
-		if usr.username == username && usr.password == password {
-			//currentUser = usr
-			return usr
-		}
+//getChatInfoFromID load a chat without its messages, for functions that do not
+//read or change messages
+func getChatInfoFromID(chatID string) (*chat, error) {
+	ch, err := chatStore.GetChatInfo(chatID)
+	if err != nil {
+		return nil, err
 	}
-	//currentUser = User{}
-	return User{}
+	return &ch, nil
 }
 
 //StartNewPeerChat start new peer to peer chat with peerUser
 func StartNewPeerChat(newChatTitle, currentUserID, userID string) (string, error) {
-
-	for _, v := range ChatList {
-		if v.ChatType == ChatTypePeer && ((v.MemberList[0].UserID == userID && v.MemberList[1].UserID == currentUserID) ||
-			(v.MemberList[1].UserID == userID && v.MemberList[0].UserID == currentUserID)) {
-			return "", fmt.Errorf("peer chat with this member is exist")
-		}
+	if userID == currentUserID {
+		return "", fmt.Errorf("can not start peer chat with yourself")
+	}
+	if _, err := GetUser(userID); err != nil {
+		return "", err
+	}
+	if err := checkNotBlocked(currentUserID, userID); err != nil {
+		return "", err
+	}
+	peerChatLock.Lock()
+	defer peerChatLock.Unlock()
+	peerChatID, err := findPeerChat(currentUserID, userID)
+	if err != nil {
+		return "", err
+	}
+	if peerChatID != "" {
+		return "", fmt.Errorf("peer chat with this member is exist")
 	}
 
 	newMember := member{
@@ -226,12 +319,20 @@ func StartNewPeerChat(newChatTitle, currentUserID, userID string) (string, error
 	newChat.addMember(&ownerMember)
 	newChat.addMember(&newMember)
 
-	ChatList = append(ChatList, newChat)
+	if err := chatStore.AddChat(newChat); err != nil {
+		return "", err
+	}
+	newChat.membershipChanged(currentUserID, userID)
 	return newChatID, nil
 }
 
-//StartNewGroupChat start new group chat
-func StartNewGroupChat(newChatTitle, currentUserID, chatType string) string {
+//StartNewGroupChat start new group or channel chat
+func StartNewGroupChat(newChatTitle, currentUserID, chatType string) (string, error) {
+	switch chatType {
+	case ChatTypePublicGroup, ChatTypePrivateGroup, ChatTypePublicCannal, ChatTypePrivateCannal:
+	default:
+		return "", fmt.Errorf("chat type must be a group or channel")
+	}
 
 	ownerMember := member{
 		ID:           createUniqID(),
@@ -250,16 +351,42 @@ func StartNewGroupChat(newChatTitle, currentUserID, chatType string) string {
 
 	newChat.addMember(&ownerMember)
 
-	ChatList = append(ChatList, newChat)
-	return newChatID
+	if err := chatStore.AddChat(newChat); err != nil {
+		return "", err
+	}
+	newChat.membershipChanged(currentUserID)
+	return newChatID, nil
 }
 
-//SendMessageToChat add message to a chat
-func SendMessageToChat(chatID, currentUserID, newMessage string) (time.Time, string, error) {
+//SendMessageToChat add message to a chat, replyToID is empty or ID of a message in the same chat,
+//attachmentIDs are uploaded attachments of current user that are sent with the message
+func SendMessageToChat(chatID, currentUserID, newMessage, replyToID string, attachmentIDs []string) (time.Time, string, []Attachment, error) {
+	cAt, newID, attachments, err := addMessageToChat(chatID, currentUserID, newMessage, replyToID, attachmentIDs)
+	if err != nil {
+		return cAt, "", nil, err
+	}
+	// the typing alert is sent out of the chat lock
+	StopTyping(chatID, currentUserID)
+	return cAt, newID, attachments, nil
+}
 
-	chat, err := getChatFromID(chatID)
+func addMessageToChat(chatID, currentUserID, newMessage, replyToID string, attachmentIDs []string) (time.Time, string, []Attachment, error) {
+	if newMessage == "" && len(attachmentIDs) == 0 {
+		return time.Now(), "", nil, fmt.Errorf("message is empty")
+	}
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
-		return time.Now(), "", err
+		return time.Now(), "", nil, err
+	}
+	if err := authorize(chat, currentUserID, ActionPost); err != nil {
+		return time.Now(), "", nil, err
+	}
+	if chat.ChatType == ChatTypePeer {
+		if peer := chat.peerOf(currentUserID); peer != nil && isBlockedBy(currentUserID, peer.UserID) {
+			return time.Now(), "", nil, ErrBlockedByUser
+		}
 	}
 
 	newID := createUniqID()
@@ -270,69 +397,171 @@ func SendMessageToChat(chatID, currentUserID, newMessage string) (time.Time, str
 		CreateAt: cAt,
 		OwnerID:  currentUserID,
 	}
-	chat.MessageList = append(chat.MessageList, newMes)
+	var root *message
+	if replyToID != "" {
+		threadRoot, err := addReply(chatID, &newMes, replyToID)
+		if err != nil {
+			return time.Now(), "", nil, err
+		}
+		root = &threadRoot
+	}
+	attachments, err := chat.attach(&newMes, attachmentIDs)
+	if err != nil {
+		return time.Now(), "", nil, err
+	}
+	if err := chatStore.AddMessage(chatID, newMes); err != nil {
+		return time.Now(), "", nil, err
+	}
+	if root != nil {
+		if err := chatStore.SaveMessage(chatID, *root); err != nil {
+			return time.Now(), "", nil, err
+		}
+	}
+	if len(attachments) > 0 {
+		if err := chatStore.SaveChat(*chat); err != nil {
+			return time.Now(), "", nil, err
+		}
+	}
+	indexMessage(chatID, newMes)
 
-	return cAt, newID, nil
+	return cAt, newID, attachments, nil
 }
 
 //JoinToChat join current user to a chat
-func JoinToChat(chatID, currentUserID string) (string, error) {
-
-	chat, err := getChatFromID(chatID)
+func JoinToChat(chatID, currentUserID string) (string, string, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	newID := createUniqID()
-	newMember := member{
-		ID:           newID,
-		UserID:       currentUserID,
-		AddedAt:      time.Now(),
-		MemberType:   MemberTypeNormal,
-		MemberStatus: MemberStatusNormal,
+	if err := authorize(chat, currentUserID, ActionJoin); err != nil {
+		return "", "", err
 	}
-
+	memberStatus := MemberStatusNormal
 	if chat.ChatType == ChatTypePrivateCannal || chat.ChatType ==
 		ChatTypePrivateGroup {
-		newMember.MemberStatus = MemberStatusRequested
+		memberStatus = MemberStatusRequested
 	}
 
-	chat.addMember(&newMember)
-	return newID, nil
+	newID := chat.admit(currentUserID, memberStatus)
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return "", "", err
+	}
+	chat.membershipChanged(currentUserID)
+	return newID, memberStatus, nil
 }
 
-//LeaveChat leave user from a chat
-func LeaveChat(chatID, currentUserID string) (string, string, error) {
-
-	chat, err := getChatFromID(chatID)
+//LeaveChat leave user from a chat, when owner of a group leave it another
+//member become owner and the role change is returned
+func LeaveChat(chatID, currentUserID string) (string, string, *RoleChange, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
-		return "", "", err
+		return "", "", nil, err
+	}
+	if err := authorize(chat, currentUserID, ActionLeave); err != nil {
+		return "", "", nil, err
 	}
 	for ind, v := range chat.MemberList {
 		if v.UserID == currentUserID {
-			chat.MemberList[ind].MemberStatus = MemberStatusLeft
+			handOver := chat.leave(ind)
 			//fmt.Println(chat)
-			return v.UserID, v.ID, nil
+			if err := chatStore.SaveChat(*chat); err != nil {
+				return "", "", nil, err
+			}
+			chat.membershipChanged(v.UserID)
+			if handOver != nil {
+				chat.membershipChanged(handOver.UserID)
+			}
+			return v.UserID, v.ID, handOver, nil
 		}
 	}
 	//fmt.Println(chat)
 
-	return "", "", nil
+	return "", "", nil, nil
 }
 
-//BlockPeerChat leave user from a chat
-func BlockPeerChat(chatID, currentUserID string) (string, string, error) {
+//leave set the member at ind as left and return the role change when another
+//member become owner
+func (ch *chat) leave(ind int) *RoleChange {
+	mem := &ch.MemberList[ind]
+	mem.MemberStatus = MemberStatusLeft
+	if mem.MemberType != MemberTypeOwner {
+		return nil
+	}
+	handOver := ch.handOverOwnership(mem.UserID)
+	if handOver != nil {
+		mem.MemberType = MemberTypeNormal
+	}
+	return handOver
+}
+
+//leaveAllChats leave a deleted user from all of its chats
+func leaveAllChats(userID string) error {
+	chatList, err := chatStore.ChatsOfUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, v := range chatList {
+		if err := leaveDeletedChat(v.ID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func leaveDeletedChat(chatID, userID string) error {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return err
+	}
+	for ind, v := range chat.MemberList {
+		if v.UserID != userID || v.MemberStatus == MemberStatusLeft {
+			continue
+		}
+		handOver := chat.leave(ind)
+		if err := chatStore.SaveChat(*chat); err != nil {
+			return err
+		}
+		chat.membershipChanged(userID)
+		if handOver != nil {
+			chat.membershipChanged(handOver.UserID)
+		}
+		return nil
+	}
+	return nil
+}
 
-	chat, err := getChatFromID(chatID)
+//BlockPeerChat block the other member of a peer chat and add it to block
+//list of current user
+func BlockPeerChat(chatID, currentUserID string) (string, string, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
 		return "", "", err
 	}
-	if chat.ChatType != ChatTypePeer {
-		return "", "", fmt.Errorf("not a peer chat")
+	if err := authorize(chat, currentUserID, ActionBlock); err != nil {
+		return "", "", err
 	}
 	for ind, v := range chat.MemberList {
 		if v.UserID != currentUserID {
+			// the user may be in the block list already by BlockUser
+			if !isBlockedBy(v.UserID, currentUserID) {
+				if err := setBlocked(currentUserID, v.UserID, true); err != nil {
+					return "", "", err
+				}
+			}
 			chat.MemberList[ind].MemberStatus = MemberStatusBlocked
 			//fmt.Println(chat)
+			if err := chatStore.SaveChat(*chat); err != nil {
+				return "", "", err
+			}
+			chat.membershipChanged(v.UserID)
 			return v.UserID, v.ID, nil
 		}
 	}
@@ -340,75 +569,117 @@ func BlockPeerChat(chatID, currentUserID string) (string, string, error) {
 	return "", "", nil
 }
 
-//ChangeMemberStatus change member status of user
+//ChangeMemberStatus change member status of user by the member status
+//transitions, owner and admins can change status of members of lower rank
 func ChangeMemberStatus(chatID, currentUserID, memberID, newMemberStatus string) (string, string, error) {
-	chat, err := getChatFromID(chatID)
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
 		return "", "", err
 	}
-	if chat.ChatType == ChatTypePeer {
-		return "", "", fmt.Errorf("not a group chat")
+	if err := authorize(chat, currentUserID, ActionManage); err != nil {
+		return "", "", err
 	}
-	for _, v := range chat.MemberList {
-		if v.UserID == currentUserID {
-			if v.MemberType != MemberTypeAamin && v.MemberType != MemberTypeOwner {
-				//fmt.Println("return")
-				return "", "", fmt.Errorf("not a valid user chat")
-			}
-		}
+	mem := chat.findMemberByID(memberID)
+	if mem == nil {
+		return "", "", fmt.Errorf("Member didnt find")
 	}
-	//fmt.Println(memberID)
-	for ind, v := range chat.MemberList {
-
-		//fmt.Println(v)
-		if v.ID == memberID {
-
-			chat.MemberList[ind].MemberStatus = newMemberStatus
-			//fmt.Println(chat)
-			return v.UserID, v.ID, nil
-		}
+	if err := chat.checkOutrank(chat.getMember(currentUserID), mem); err != nil {
+		return "", "", err
 	}
-
-	return "", "", nil
+	if err := checkStatusTransition(mem.MemberStatus, newMemberStatus); err != nil {
+		return "", "", err
+	}
+	if mem.MemberStatus == MemberStatusRequested {
+		mem.AddedAt = time.Now()
+	}
+	mem.MemberStatus = newMemberStatus
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return "", "", err
+	}
+	chat.membershipChanged(mem.UserID)
+	return mem.UserID, mem.ID, nil
 }
 
 //AddOtherUserToChat add other user to a chat
 func AddOtherUserToChat(chatID, currentUserID, userID string) (string, string, error) {
-
-	chat, err := getChatFromID(chatID)
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
 		return "", "", err
 	}
-	newID := createUniqID()
-	newMember := member{
-		ID:           newID,
-		UserID:       userID,
-		AddedAt:      time.Now(),
-		MemberType:   MemberTypeNormal,
-		MemberStatus: MemberStatusNormal,
+	if err := authorize(chat, currentUserID, ActionAddMember); err != nil {
+		return "", "", err
+	}
+	if isBlockedBy(currentUserID, userID) {
+		return "", "", ErrBlockedByUser
+	}
+	if mem := chat.getMember(userID); mem != nil {
+		switch mem.MemberStatus {
+		case MemberStatusNormal:
+			return "", "", ErrAlreadyMember
+		case MemberStatusBlocked, MemberStatusExpeled:
+			// only managers can bring back a removed member
+			if err := authorize(chat, currentUserID, ActionManage); err != nil {
+				return "", "", err
+			}
+		}
 	}
 
-	chat.addMember(&newMember)
+	newID := chat.admit(userID, MemberStatusNormal)
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return "", "", err
+	}
+	chat.membershipChanged(userID)
 	return chat.Title, newID, nil
 }
 
 //SendAlertToMember send a alert to all member of chat
-func SendAlertToMember(chatID string, newAlert interface{}) {
-	chat, err := getChatFromID(chatID)
+func SendAlertToMember(chatID string, newAlert Alert) {
+	chat, err := getChatInfoFromID(chatID)
 	if err != nil {
 		return
 	}
 	for _, v := range chat.MemberList {
 		if v.MemberStatus == MemberStatusNormal {
-			UserChannel(v.UserID).Submit(newAlert)
+			getUserChannel(v.UserID).submit(newAlert)
+		}
+	}
+
+}
+
+//SendAlertToOtherMembers send a alert to all member of chat except one user
+func SendAlertToOtherMembers(chatID, exceptUserID string, newAlert Alert) {
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return
+	}
+	for _, v := range chat.MemberList {
+		if v.MemberStatus == MemberStatusNormal && v.UserID != exceptUserID {
+			getUserChannel(v.UserID).submit(newAlert)
 		}
 	}
+}
 
+//sendEphemeralToOtherMembers send a alert that is not logged to all member of
+//chat except one user, it is lost for members that are not listening
+func sendEphemeralToOtherMembers(chatID, exceptUserID string, newAlert Alert) {
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return
+	}
+	for _, v := range chat.MemberList {
+		if v.MemberStatus == MemberStatusNormal && v.UserID != exceptUserID {
+			getUserChannel(v.UserID).broadcast(newAlert)
+		}
+	}
 }
 
 //SendAlertToOneMember send a alert to a member
-func SendAlertToOneMember(userID string, newAlert interface{}) {
-	UserChannel(userID).Submit(newAlert)
+func SendAlertToOneMember(userID string, newAlert Alert) {
+	getUserChannel(userID).submit(newAlert)
 }
 
 //GetChat return a chat as json byte array
@@ -419,25 +690,18 @@ func GetChat(chatID, currentUserID string) (string, error) {
 	}
 	chat := chatf
 
-	isUserMemberOfChat := false
-	for _, v := range chat.MemberList {
-		if v.UserID == currentUserID {
-			isUserMemberOfChat = true
-			break
-		}
-	}
-	if !isUserMemberOfChat {
-		return "", fmt.Errorf("User isn't member of chat")
+	if err := authorize(chat, currentUserID, ActionRead); err != nil {
+		return "", err
 	}
+	subscriberCount := chat.subscriberCount()
+	chat.viewFor(currentUserID)
 	if chat.ChatType == ChatTypePeer {
-		if chat.MemberList[0].UserID == currentUserID {
-			chat.Title = chat.MemberList[1].UserID
-		} else {
-			chat.Title = chat.MemberList[0].UserID
+		if peer := chat.peerOf(currentUserID); peer != nil {
+			chat.Title = peer.UserID
 		}
 	}
 	//fmt.Println(chat, *chat)
-	jChat, err := json.Marshal(*chat)
+	jChat, err := json.Marshal(chatDetail{chat: *chat, SubscriberCount: subscriberCount})
 	//fmt.Println(string(jChat))
 	if err != nil {
 		return "", err
@@ -445,14 +709,36 @@ func GetChat(chatID, currentUserID string) (string, error) {
 	return string(jChat), nil
 }
 
+type chatDetail struct {
+	chat
+	SubscriberCount int `json:",omitempty"`
+}
+
+type chatListItem struct {
+	chat
+	UnreadCount     int
+	SubscriberCount int `json:",omitempty"`
+}
+
 //GetChatList return user chat list as json byte array
 func GetChatList(currentUserID string) (string, error) {
-	var tmpList []chat
-	for _, v := range ChatList {
-		if v.findMember(currentUserID) {
-
-			tmpList = append(tmpList, v)
+	chatList, err := chatStore.ChatsOfUser(currentUserID)
+	if err != nil {
+		return "", err
+	}
+	var tmpList []chatListItem
+	for _, info := range chatList {
+		if authorize(&info, currentUserID, ActionRead) != nil {
+			continue
 		}
+		// the list show messages and unread counts, load them for readable chats only
+		v, err := chatStore.GetChat(info.ID)
+		if err != nil {
+			return "", err
+		}
+		subscriberCount := v.subscriberCount()
+		v.viewFor(currentUserID)
+		tmpList = append(tmpList, chatListItem{chat: v, UnreadCount: v.unreadCount(currentUserID), SubscriberCount: subscriberCount})
 	}
 	//fmt.Println(chat, *chat)
 	jChat, err := json.Marshal(tmpList)
@@ -467,36 +753,182 @@ func GetChatList(currentUserID string) (string, error) {
 /*					realtime functions								*/
 /*																	*/
 /********************************************************************/
-var userChannels = make(map[string]broadcast.Broadcaster)
+//eventLogSize is count of last alerts kept per user for resuming streams
+const eventLogSize = 100
+
+type userChannel struct {
+	lock        sync.Mutex
+	broadcaster broadcast.Broadcaster
+	lastEventID uint64
+	eventLog    []Alert
+	// listeners is count of registered listeners
+	listeners int
+	// done is closed when the user is deleted, listeners must close then
+	done      chan struct{}
+	isDeleted bool
+	// isRemoved is set when the broadcaster is closed and the channel is not in
+	// userChannels anymore
+	isRemoved bool
+}
+
+var userChannels = make(map[string]*userChannel)
+var userChannelsLock sync.Mutex
+
+func getUserChannel(userid string) *userChannel {
+	userChannelsLock.Lock()
+	defer userChannelsLock.Unlock()
+	uc, ok := userChannels[userid]
+	if !ok {
+		uc = &userChannel{
+			broadcaster: broadcast.NewBroadcaster(10),
+			// start from the clock so IDs keep growing after a restart
+			lastEventID: uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+			done:        make(chan struct{}),
+		}
+		userChannels[userid] = uc
+	}
+	return uc
+}
+
+//lockUserChannel return the locked channel of user, a removed channel is
+//skipped so its closed broadcaster is never used
+func lockUserChannel(userid string) *userChannel {
+	for {
+		uc := getUserChannel(userid)
+		uc.lock.Lock()
+		if !uc.isRemoved {
+			return uc
+		}
+		uc.lock.Unlock()
+	}
+}
+
+//remove close the broadcaster and remove the channel from userChannels, uc
+//must be locked and have no listener
+func (uc *userChannel) remove(userid string) {
+	uc.broadcaster.Close()
+	uc.isRemoved = true
+	userChannelsLock.Lock()
+	if userChannels[userid] == uc {
+		delete(userChannels, userid)
+	}
+	userChannelsLock.Unlock()
+}
+
+//submit give the alert the next event ID, keep it in the log and broadcast it
+func (uc *userChannel) submit(newAlert Alert) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	if uc.isRemoved {
+		return
+	}
+	uc.lastEventID++
+	newAlert.ID = uc.lastEventID
+	uc.eventLog = append(uc.eventLog, newAlert)
+	if len(uc.eventLog) > eventLogSize {
+		uc.eventLog = uc.eventLog[len(uc.eventLog)-eventLogSize:]
+	}
+	uc.broadcaster.Submit(newAlert)
+}
+
+//broadcast send the alert to open listeners only, it has no event ID and is not
+//kept in the log so a resumed stream never replay it
+func (uc *userChannel) broadcast(newAlert Alert) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	if uc.isRemoved {
+		return
+	}
+	newAlert.ID = 0
+	uc.broadcaster.Submit(newAlert)
+}
 
 //OpenListener open listener
 func OpenListener(userid string) chan interface{} {
+	// presence alerts may block, send them before there is an unread listener
+	userConnected(userid)
+	uc := lockUserChannel(userid)
+	defer uc.lock.Unlock()
 	listener := make(chan interface{})
-	UserChannel(userid).Register(listener)
+	uc.broadcaster.Register(listener)
+	uc.listeners++
 	return listener
 }
 
+//OpenListenerFrom open listener and return the logged alerts after lastEventID,
+//an EventsLost alert is first when some of them are not in the log anymore.
+//The listener may also receive some of the returned alerts, skip IDs that are already seen.
+func OpenListenerFrom(userid string, lastEventID uint64) (chan interface{}, []Alert) {
+	userConnected(userid)
+	uc := lockUserChannel(userid)
+	defer uc.lock.Unlock()
+	listener := make(chan interface{})
+	uc.broadcaster.Register(listener)
+	uc.listeners++
+
+	var missed []Alert
+	if lastEventID == 0 {
+		return listener, missed
+	}
+	if lastEventID < uc.lastEventID && (len(uc.eventLog) == 0 || uc.eventLog[0].ID > lastEventID+1) {
+		missed = append(missed, Alert{AlertType: "EventsLost"})
+	}
+	for _, v := range uc.eventLog {
+		if v.ID > lastEventID {
+			missed = append(missed, v)
+		}
+	}
+	return listener, missed
+}
+
 //CloseListener close listener
 func CloseListener(userid string, listener chan interface{}) {
-	UserChannel(userid).Unregister(listener)
+	// the broadcaster may be blocked sending to this listener, drain it until closed
+	go func() {
+		for range listener {
+		}
+	}()
+	// a channel is not removed while it has listeners so this is the channel
+	// that listener is registered to
+	uc := lockUserChannel(userid)
+	uc.broadcaster.Unregister(listener)
+	uc.listeners--
+	if uc.isDeleted && uc.listeners == 0 {
+		uc.remove(userid)
+	}
+	uc.lock.Unlock()
 	close(listener)
+	userDisconnected(userid)
 }
 
-//DeleteBroadcast delete broadcast
+//ListenerDone return a channel that is closed when the user is deleted, open
+//listeners of user must be closed with CloseListener then
+func ListenerDone(userid string) <-chan struct{} {
+	return getUserChannel(userid).done
+}
+
+//DeleteBroadcast delete broadcast of user, listeners are told to stop and the
+//broadcaster is closed when the last one of them is closed
 func DeleteBroadcast(userid string) {
-	b, ok := userChannels[userid]
-	if ok {
-		b.Close()
-		delete(userChannels, userid)
+	userChannelsLock.Lock()
+	uc, ok := userChannels[userid]
+	userChannelsLock.Unlock()
+	if !ok {
+		return
+	}
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	if uc.isDeleted || uc.isRemoved {
+		return
+	}
+	uc.isDeleted = true
+	close(uc.done)
+	if uc.listeners == 0 {
+		uc.remove(userid)
 	}
 }
 
 //UserChannel get user channel
 func UserChannel(userid string) broadcast.Broadcaster {
-	b, ok := userChannels[userid]
-	if !ok {
-		b = broadcast.NewBroadcaster(10)
-		userChannels[userid] = b
-	}
-	return b
+	return getUserChannel(userid).broadcaster
 }
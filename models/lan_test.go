@@ -0,0 +1,212 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//useMemoryStore give the test an empty memory chat store
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	if err := SetChatStore(NewMemoryChatStore()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentJoinAndSend(t *testing.T) {
+	useMemoryStore(t)
+	const users = 20
+	const messages = 10
+	chatID, err := StartNewGroupChat("stress", "owner", ChatTypePublicGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, users*(messages+1))
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			if _, _, err := JoinToChat(chatID, userID); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < messages; j++ {
+				if _, _, _, err := SendMessageToChat(chatID, userID, fmt.Sprint("message ", j), "", nil); err != nil {
+					errs <- err
+				}
+			}
+		}(fmt.Sprint("user", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	ch, err := chatStore.GetChat(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.MemberList) != users+1 {
+		t.Errorf("got %d members, want %d", len(ch.MemberList), users+1)
+	}
+	if len(ch.MessageList) != users*messages {
+		t.Errorf("got %d messages, want %d", len(ch.MessageList), users*messages)
+	}
+}
+
+func TestConcurrentJoinSameUser(t *testing.T) {
+	useMemoryStore(t)
+	chatID, err := StartNewGroupChat("stress", "owner", ChatTypePublicGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			JoinToChat(chatID, "user")
+		}()
+	}
+	wg.Wait()
+
+	ch, err := chatStore.GetChat(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, v := range ch.MemberList {
+		if v.UserID == "user" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("user is member %d times", count)
+	}
+}
+
+func TestConcurrentListeners(t *testing.T) {
+	useMemoryStore(t)
+	const users = 5
+	chatID, err := StartNewGroupChat("stress", "owner", ChatTypePublicGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userIDs := []string{"owner"}
+	for i := 0; i < users; i++ {
+		userID := fmt.Sprint("listener", i)
+		if _, _, err := JoinToChat(chatID, userID); err != nil {
+			t.Fatal(err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	done := make(chan struct{})
+	var senders sync.WaitGroup
+	for _, userID := range userIDs {
+		senders.Add(1)
+		go func(userID string) {
+			defer senders.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, _, _, err := SendMessageToChat(chatID, userID, "hi", "", nil); err != nil {
+					t.Error(err)
+					return
+				}
+				SendAlertToMember(chatID, Alert{AlertType: "NewMessage", Data: chatID})
+			}
+		}(userID)
+	}
+
+	var listeners sync.WaitGroup
+	for _, userID := range userIDs {
+		for i := 0; i < 4; i++ {
+			listeners.Add(1)
+			go func(userID string, resume bool) {
+				defer listeners.Done()
+				for j := 0; j < 20; j++ {
+					var listener chan interface{}
+					if resume {
+						listener, _ = OpenListenerFrom(userID, 1)
+					} else {
+						listener = OpenListener(userID)
+					}
+					select {
+					case <-listener:
+					case <-time.After(10 * time.Millisecond):
+					}
+					CloseListener(userID, listener)
+				}
+			}(userID, i%2 == 0)
+		}
+	}
+	listeners.Wait()
+	close(done)
+	senders.Wait()
+
+	for _, userID := range userIDs {
+		presences.Lock()
+		p := getPresence(userID)
+		open, status := p.listeners, p.status
+		presences.Unlock()
+		if open != 0 || status != PresenceOffline {
+			t.Errorf("%s has %d listeners and is %s after all are closed", userID, open, status)
+		}
+	}
+}
+
+func TestStartNewPeerChat(t *testing.T) {
+	useMemoryStore(t)
+	SetUserStore(NewMemoryUserStore())
+	for _, userID := range []string{"user1", "user2"} {
+		if _, err := RegisterUser(userID, userID, "password", userID, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := StartNewPeerChat("self", "user1", "user1"); err == nil {
+		t.Error("peer chat with self is created")
+	}
+	if _, err := StartNewPeerChat("missing", "user1", "nobody"); err == nil {
+		t.Error("peer chat with a missing user is created")
+	}
+	chatID, err := StartNewPeerChat("peer", "user1", "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartNewPeerChat("again", "user2", "user1"); err == nil {
+		t.Error("second peer chat of the same users is created")
+	}
+	if found, _ := findPeerChat("user2", "user1"); found != chatID {
+		t.Errorf("found peer chat %q, want %q", found, chatID)
+	}
+}
+
+func TestPeerChatWithOneMember(t *testing.T) {
+	useMemoryStore(t)
+	// peer chats with self were created before they were rejected
+	ch := chat{ID: "self", Title: "self", ChatType: ChatTypePeer, CreateAt: time.Now()}
+	ch.addMember(&member{ID: "m1", UserID: "user1", MemberType: MemberTypeOwner, MemberStatus: MemberStatusNormal})
+	if err := chatStore.AddChat(ch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetChat("self", "user1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := GetChatList("user1"); err != nil {
+		t.Error(err)
+	}
+	if found, _ := findPeerChat("user1", "user1"); found != "" {
+		t.Errorf("found peer chat %q for one user", found)
+	}
+}
@@ -0,0 +1,117 @@
+package models
+
+import "fmt"
+
+//RoleChange is a change of the member type of a chat member
+type RoleChange struct {
+	ChatID     string
+	MemberID   string
+	UserID     string
+	MemberType MemberType
+	// ChangedBy is the user that changed the role
+	ChangedBy string
+}
+
+func (ch *chat) findMemberByID(memberID string) *member {
+	for ind, v := range ch.MemberList {
+		if v.ID == memberID {
+			return &ch.MemberList[ind]
+		}
+	}
+	return nil
+}
+
+//SetMemberRole promote a normal member to admin or demote an admin to normal
+//member, only owner of chat can do it
+func SetMemberRole(chatID, currentUserID, memberID string, memberType MemberType) (RoleChange, error) {
+	if memberType != MemberTypeAamin && memberType != MemberTypeNormal {
+		return RoleChange{}, fmt.Errorf("role must be admin or normal member")
+	}
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return RoleChange{}, err
+	}
+	if err := authorize(chat, currentUserID, ActionOwn); err != nil {
+		return RoleChange{}, err
+	}
+	mem := chat.findMemberByID(memberID)
+	if mem == nil {
+		return RoleChange{}, fmt.Errorf("Member didnt find")
+	}
+	if mem.MemberType == MemberTypeOwner {
+		return RoleChange{}, fmt.Errorf("role of owner can not change, transfer the ownership instead")
+	}
+	if mem.MemberStatus != MemberStatusNormal {
+		return RoleChange{}, fmt.Errorf("only normal members can get a role")
+	}
+	if mem.MemberType == memberType {
+		return RoleChange{}, fmt.Errorf("member has this role already")
+	}
+	mem.MemberType = memberType
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return RoleChange{}, err
+	}
+	chat.membershipChanged(mem.UserID)
+	return RoleChange{chatID, mem.ID, mem.UserID, memberType, currentUserID}, nil
+}
+
+//TransferOwnership make another normal member owner of chat and current
+//owner an admin
+func TransferOwnership(chatID, currentUserID, memberID string) ([]RoleChange, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(chat, currentUserID, ActionOwn); err != nil {
+		return nil, err
+	}
+	newOwner := chat.findMemberByID(memberID)
+	if newOwner == nil {
+		return nil, fmt.Errorf("Member didnt find")
+	}
+	if newOwner.UserID == currentUserID {
+		return nil, fmt.Errorf("member is owner of chat already")
+	}
+	if newOwner.MemberStatus != MemberStatusNormal {
+		return nil, fmt.Errorf("only normal members can own chat")
+	}
+	oldOwner := chat.getMember(currentUserID)
+	oldOwner.MemberType = MemberTypeAamin
+	newOwner.MemberType = MemberTypeOwner
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return nil, err
+	}
+	chat.membershipChanged(oldOwner.UserID, newOwner.UserID)
+	return []RoleChange{
+		{chatID, newOwner.ID, newOwner.UserID, MemberTypeOwner, currentUserID},
+		{chatID, oldOwner.ID, oldOwner.UserID, MemberTypeAamin, currentUserID},
+	}, nil
+}
+
+//handOverOwnership make the oldest admin, or the oldest member if there is no
+//admin, owner of a group chat that its owner left, it return nil if there is
+//no one to own the chat
+func (ch *chat) handOverOwnership(leftUserID string) *RoleChange {
+	if ch.ChatType == ChatTypePeer {
+		return nil
+	}
+	var newOwner *member
+	for ind, v := range ch.MemberList {
+		if v.MemberStatus != MemberStatusNormal || v.UserID == leftUserID {
+			continue
+		}
+		if newOwner == nil || (v.MemberType == MemberTypeAamin && newOwner.MemberType != MemberTypeAamin) ||
+			(v.MemberType == newOwner.MemberType && v.AddedAt.Before(newOwner.AddedAt)) {
+			newOwner = &ch.MemberList[ind]
+		}
+	}
+	if newOwner == nil {
+		return nil
+	}
+	newOwner.MemberType = MemberTypeOwner
+	return &RoleChange{ch.ID, newOwner.ID, newOwner.UserID, MemberTypeOwner, leftUserID}
+}
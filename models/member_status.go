@@ -0,0 +1,46 @@
+package models
+
+import "fmt"
+
+//memberStatusTransitions are the status changes that owner and admins can
+//apply to other members, members leave and request to join by themselves
+var memberStatusTransitions = map[string][]string{
+	MemberStatusNormal:    {MemberStatusBlocked, MemberStatusExpeled},
+	MemberStatusBlocked:   {MemberStatusNormal, MemberStatusExpeled},
+	MemberStatusRequested: {MemberStatusNormal, MemberStatusExpeled},
+	MemberStatusLeft:      {},
+	MemberStatusExpeled:   {},
+}
+
+//checkStatusTransition return an error if status of member can not change
+//from one status to another
+func checkStatusTransition(from, to string) error {
+	if _, ok := memberStatusTransitions[to]; !ok {
+		return fmt.Errorf("unknown member status %q", to)
+	}
+	for _, v := range memberStatusTransitions[from] {
+		if v == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("member status can not change from %s to %s", from, to)
+}
+
+//checkOutrank return a *PermissionError if current member can not change
+//status of the other member, owner can not be changed and admins can only
+//change normal members
+func (ch *chat) checkOutrank(current, other *member) error {
+	deny := func(err error) error {
+		return &PermissionError{UserID: current.UserID, ChatID: ch.ID, Action: ActionManage, Err: err}
+	}
+	if current.ID == other.ID {
+		return deny(ErrSelfStatus)
+	}
+	if other.MemberType == MemberTypeOwner {
+		return deny(ErrOutranked)
+	}
+	if current.MemberType != MemberTypeOwner && other.MemberType == MemberTypeAamin {
+		return deny(ErrOutranked)
+	}
+	return nil
+}
@@ -0,0 +1,480 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// PageBefore load messages older than the cursor
+	PageBefore string = "before"
+	// PageAfter load messages newer than the cursor
+	PageAfter string = "after"
+
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+
+	maxEmojiLength = 32
+)
+
+type messagePage struct {
+	Messages []message
+	// NextCursor continue in the same direction, empty when there is no more message
+	NextCursor string
+	// PrevCursor go back in the other direction, empty at the end of history
+	PrevCursor string
+}
+
+//cursorIndex return index of the first message after the cursor, the cursor is
+//a message ID or a RFC3339 time
+func (ch *chat) cursorIndex(cursor string) (int, bool, error) {
+	for ind, v := range ch.MessageList {
+		if v.ID == cursor {
+			return ind, true, nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid cursor")
+	}
+	for ind, v := range ch.MessageList {
+		if v.CreateAt.After(t) {
+			return ind, false, nil
+		}
+	}
+	return len(ch.MessageList), false, nil
+}
+
+//GetMessages return a page of messages of a chat as json string
+func GetMessages(chatID, currentUserID, cursor, direction string, limit int) (string, error) {
+	chat, err := getChatFromID(chatID)
+	if err != nil {
+		return "", err
+	}
+	if err := authorize(chat, currentUserID, ActionRead); err != nil {
+		return "", err
+	}
+	if direction == "" {
+		direction = PageBefore
+	}
+	if direction != PageBefore && direction != PageAfter {
+		return "", fmt.Errorf("direction must be %s or %s", PageBefore, PageAfter)
+	}
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	// the cursor can be a message that current user deleted for own view, so
+	// find it before those messages are removed and then skip them in the count
+	boundary := 0
+	if direction == PageBefore {
+		boundary = len(chat.MessageList)
+	}
+	if cursor != "" {
+		var isID bool
+		boundary, isID, err = chat.cursorIndex(cursor)
+		if err != nil {
+			return "", err
+		}
+		if isID && direction == PageAfter {
+			boundary++
+		}
+	}
+	hidden := 0
+	for _, v := range chat.MessageList[:boundary] {
+		if v.isHiddenFor(currentUserID) {
+			hidden++
+		}
+	}
+	boundary -= hidden
+	chat.viewFor(currentUserID)
+
+	// messages in [from, to) are returned
+	var from, to int
+	if direction == PageBefore {
+		to = boundary
+		from = to - limit
+		if from < 0 {
+			from = 0
+		}
+	} else {
+		from = boundary
+		to = from + limit
+		if to > len(chat.MessageList) {
+			to = len(chat.MessageList)
+		}
+	}
+
+	page := messagePage{Messages: append([]message{}, chat.MessageList[from:to]...)}
+	if from < to {
+		oldest, newest := chat.MessageList[from].ID, chat.MessageList[to-1].ID
+		hasOlder, hasNewer := from > 0, to < len(chat.MessageList)
+		if direction == PageBefore {
+			if hasOlder {
+				page.NextCursor = oldest
+			}
+			if hasNewer {
+				page.PrevCursor = newest
+			}
+		} else {
+			if hasNewer {
+				page.NextCursor = newest
+			}
+			if hasOlder {
+				page.PrevCursor = oldest
+			}
+		}
+	}
+
+	jPage, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	return string(jPage), nil
+}
+
+func (ch *chat) findMessage(messageID string) (int, error) {
+	for ind, v := range ch.MessageList {
+		if v.ID == messageID {
+			return ind, nil
+		}
+	}
+	return -1, fmt.Errorf("Message didnt find")
+}
+
+//EditMessage change content of a message of current user and keep the old content in history
+func EditMessage(chatID, currentUserID, messageID, newContent string) (message, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return message{}, err
+	}
+	if err := authorize(chat, currentUserID, ActionPost); err != nil {
+		return message{}, err
+	}
+	storedMes, err := chatStore.GetMessage(chatID, messageID)
+	if err != nil {
+		return message{}, err
+	}
+	mes := &storedMes
+	if mes.OwnerID != currentUserID {
+		return message{}, fmt.Errorf("only owner of message can edit it")
+	}
+	if mes.DeletedAt != nil {
+		return message{}, fmt.Errorf("message is deleted")
+	}
+	if mes.Content == newContent {
+		return mes.clone(), nil
+	}
+
+	versionCreateAt := mes.CreateAt
+	if mes.EditedAt != nil {
+		versionCreateAt = *mes.EditedAt
+	}
+	mes.History = append(mes.History, messageVersion{
+		Content:  mes.Content,
+		CreateAt: versionCreateAt,
+	})
+	editedAt := time.Now()
+	mes.Content = newContent
+	mes.EditedAt = &editedAt
+	if err := chatStore.SaveMessage(chatID, *mes); err != nil {
+		return message{}, err
+	}
+	indexMessage(chatID, *mes)
+	return mes.clone(), nil
+}
+
+func (m *message) isHiddenFor(userID string) bool {
+	for _, v := range m.HiddenFor {
+		if v == userID {
+			return true
+		}
+	}
+	return false
+}
+
+//DeleteMessage hide a message for current user or delete it for everyone, only owner
+//of message or owner and admins of chat can delete for everyone
+func DeleteMessage(chatID, currentUserID, messageID string, forEveryone bool) error {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatFromID(chatID)
+	if err != nil {
+		return err
+	}
+	if err := authorize(chat, currentUserID, ActionRead); err != nil {
+		return err
+	}
+	ind, err := chat.findMessage(messageID)
+	if err != nil {
+		return err
+	}
+	mes := &chat.MessageList[ind]
+
+	if !forEveryone {
+		if mes.isHiddenFor(currentUserID) {
+			return fmt.Errorf("Message didnt find")
+		}
+		mes.HiddenFor = append(mes.HiddenFor, currentUserID)
+		return chatStore.SaveMessage(chatID, *mes)
+	}
+
+	action := ActionPost
+	if mes.OwnerID != currentUserID {
+		action = ActionManage
+	}
+	if err := authorize(chat, currentUserID, action); err != nil {
+		return err
+	}
+	if mes.DeletedAt != nil {
+		return fmt.Errorf("message is deleted")
+	}
+	deletedAt := time.Now()
+	mes.DeletedAt = &deletedAt
+	mes.Content = ""
+	mes.History = nil
+	hasAttachments := len(mes.AttachmentIDs) > 0
+	chat.removeAttachments(mes.AttachmentIDs)
+	mes.AttachmentIDs = nil
+	if err := chatStore.SaveMessage(chatID, *mes); err != nil {
+		return err
+	}
+	if mes.ThreadID != "" {
+		if rootInd, err := chat.findMessage(mes.ThreadID); err == nil && chat.MessageList[rootInd].ReplyCount > 0 {
+			chat.MessageList[rootInd].ReplyCount--
+			if err := chatStore.SaveMessage(chatID, chat.MessageList[rootInd]); err != nil {
+				return err
+			}
+		}
+	}
+	if hasAttachments {
+		if err := chatStore.SaveChat(*chat); err != nil {
+			return err
+		}
+	}
+	unindexMessage(chatID, messageID)
+	return nil
+}
+
+//unreadCount count messages of others after the last read message of user and
+//after the user is added to the chat
+func (ch *chat) unreadCount(userID string) int {
+	mem := ch.getMember(userID)
+	if mem == nil {
+		return 0
+	}
+	count := 0
+	isRead := mem.LastReadMessageID != ""
+	for i := len(ch.MessageList) - 1; i >= 0; i-- {
+		v := ch.MessageList[i]
+		if isRead && v.ID == mem.LastReadMessageID {
+			break
+		}
+		if !v.CreateAt.After(mem.AddedAt) {
+			break
+		}
+		if v.OwnerID != userID && v.DeletedAt == nil && !v.isHiddenFor(userID) {
+			count++
+		}
+	}
+	return count
+}
+
+//MarkRead mark messages of chat until messageID as read by current user, it
+//return false when a later message is already marked
+func MarkRead(chatID, currentUserID, messageID string) (bool, error) {
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatFromID(chatID)
+	if err != nil {
+		return false, err
+	}
+	if err := authorize(chat, currentUserID, ActionRead); err != nil {
+		return false, err
+	}
+	ind, err := chat.findMessage(messageID)
+	if err != nil {
+		return false, err
+	}
+	mem := chat.getMember(currentUserID)
+	if mem.LastReadMessageID != "" {
+		if lastInd, err := chat.findMessage(mem.LastReadMessageID); err == nil && lastInd >= ind {
+			return false, nil
+		}
+	}
+	mem.LastReadMessageID = chat.MessageList[ind].ID
+	if err := chatStore.SaveChat(*chat); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//addReply link the new message to the message it reply to and return the thread
+//root with the new reply counted, the root is not saved
+func addReply(chatID string, newMes *message, replyToID string) (message, error) {
+	replyTo, err := chatStore.GetMessage(chatID, replyToID)
+	if err != nil {
+		return message{}, fmt.Errorf("replied message didnt find")
+	}
+	if replyTo.DeletedAt != nil {
+		return message{}, fmt.Errorf("replied message is deleted")
+	}
+	newMes.ReplyToID = replyToID
+	newMes.ThreadID = replyTo.ThreadID
+	if newMes.ThreadID == "" {
+		newMes.ThreadID = replyToID
+	}
+	root := replyTo
+	if newMes.ThreadID != replyToID {
+		root, err = chatStore.GetMessage(chatID, newMes.ThreadID)
+		if err != nil {
+			return message{}, err
+		}
+	}
+	root.ReplyCount++
+	return root, nil
+}
+
+type thread struct {
+	// Root is nil when current user deleted it only for own view
+	Root    *message
+	Replies []message
+}
+
+//GetThread return a root message with all replies of its thread as json string,
+//messageID can be the root or any reply of the thread
+func GetThread(chatID, currentUserID, messageID string) (string, error) {
+	chat, err := getChatFromID(chatID)
+	if err != nil {
+		return "", err
+	}
+	if err := authorize(chat, currentUserID, ActionRead); err != nil {
+		return "", err
+	}
+	ind, err := chat.findMessage(messageID)
+	if err != nil {
+		return "", err
+	}
+	rootID := chat.MessageList[ind].ThreadID
+	if rootID == "" {
+		rootID = messageID
+	}
+	rootInd, err := chat.findMessage(rootID)
+	if err != nil {
+		return "", err
+	}
+	th := thread{Replies: []message{}}
+	if root := chat.MessageList[rootInd]; !root.isHiddenFor(currentUserID) {
+		root.HiddenFor = nil
+		th.Root = &root
+	}
+	chat.viewFor(currentUserID)
+	for _, v := range chat.MessageList {
+		if v.ThreadID == rootID {
+			th.Replies = append(th.Replies, v)
+		}
+	}
+	jThread, err := json.Marshal(th)
+	if err != nil {
+		return "", err
+	}
+	return string(jThread), nil
+}
+
+//changeReaction add or remove reaction of current user to a message and return
+//the reactions of the message, changed is false when there was nothing to do
+func changeReaction(chatID, currentUserID, messageID, emoji string, isAdd bool) ([]Reaction, bool, error) {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) || strings.ContainsAny(emoji, " \t\n") {
+		return nil, false, fmt.Errorf("invalid emoji")
+	}
+	unlock := lockChat(chatID)
+	defer unlock()
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := authorize(chat, currentUserID, ActionReact); err != nil {
+		return nil, false, err
+	}
+	storedMes, err := chatStore.GetMessage(chatID, messageID)
+	if err != nil {
+		return nil, false, err
+	}
+	mes := &storedMes
+	if mes.DeletedAt != nil {
+		return nil, false, fmt.Errorf("message is deleted")
+	}
+
+	var changed bool
+	if isAdd {
+		changed = mes.addReaction(currentUserID, emoji)
+	} else {
+		changed = mes.removeReaction(currentUserID, emoji)
+	}
+	if !changed {
+		return mes.clone().Reactions, false, nil
+	}
+	if err := chatStore.SaveMessage(chatID, *mes); err != nil {
+		return nil, false, err
+	}
+	return mes.clone().Reactions, true, nil
+}
+
+func (m *message) addReaction(userID, emoji string) bool {
+	for ind, v := range m.Reactions {
+		if v.Emoji != emoji {
+			continue
+		}
+		for _, u := range v.UserIDs {
+			if u == userID {
+				return false
+			}
+		}
+		m.Reactions[ind].UserIDs = append(v.UserIDs, userID)
+		m.Reactions[ind].Count = len(m.Reactions[ind].UserIDs)
+		return true
+	}
+	m.Reactions = append(m.Reactions, Reaction{Emoji: emoji, Count: 1, UserIDs: []string{userID}})
+	return true
+}
+
+func (m *message) removeReaction(userID, emoji string) bool {
+	for ind, v := range m.Reactions {
+		if v.Emoji != emoji {
+			continue
+		}
+		for i, u := range v.UserIDs {
+			if u != userID {
+				continue
+			}
+			v.UserIDs = append(v.UserIDs[:i], v.UserIDs[i+1:]...)
+			if len(v.UserIDs) == 0 {
+				m.Reactions = append(m.Reactions[:ind], m.Reactions[ind+1:]...)
+			} else {
+				m.Reactions[ind].UserIDs = v.UserIDs
+				m.Reactions[ind].Count = len(v.UserIDs)
+			}
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+//React add a reaction of current user to a message
+func React(chatID, currentUserID, messageID, emoji string) ([]Reaction, bool, error) {
+	return changeReaction(chatID, currentUserID, messageID, emoji, true)
+}
+
+//Unreact remove a reaction of current user from a message
+func Unreact(chatID, currentUserID, messageID, emoji string) ([]Reaction, bool, error) {
+	return changeReaction(chatID, currentUserID, messageID, emoji, false)
+}
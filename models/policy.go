@@ -0,0 +1,167 @@
+package models
+
+import "errors"
+
+//Action is an operation on a chat that needs permission
+type Action string
+
+const (
+	// ActionRead read chat, messages, threads and attachments
+	ActionRead Action = "read"
+	// ActionPost send, edit and delete own messages, upload files and typing
+	ActionPost Action = "post"
+	// ActionReact react to messages
+	ActionReact Action = "react"
+	// ActionJoin join to a group or channel
+	ActionJoin Action = "join"
+	// ActionLeave leave a chat or cancel a join request
+	ActionLeave Action = "leave"
+	// ActionAddMember add another user to chat
+	ActionAddMember Action = "addMember"
+	// ActionBlock block the other member of a peer chat
+	ActionBlock Action = "block"
+	// ActionUnblock unblock the other member of a peer chat or change its status
+	// by block list of user, a blocked peer can do it too
+	ActionUnblock Action = "unblock"
+	// ActionManage change members, answer join requests, manage invites and
+	// delete messages of others
+	ActionManage Action = "manage"
+	// ActionOwn change roles of members and transfer ownership
+	ActionOwn Action = "own"
+)
+
+var (
+	// ErrNotMember user is not a normal member of chat
+	ErrNotMember = errors.New("User isn't member of chat")
+	// ErrBanned user is blocked or expeled from chat
+	ErrBanned = errors.New("user is blocked or expeled from chat")
+	// ErrNotManager action needs owner or admin of chat
+	ErrNotManager = errors.New("only owner or admin can do this")
+	// ErrNotOwner action needs owner of chat
+	ErrNotOwner = errors.New("only owner of chat can do this")
+	// ErrOutranked owner can not be changed by others and admins can not
+	// change other admins
+	ErrOutranked = errors.New("admins can not change owner or other admins")
+	// ErrSelfStatus members can not change their own status
+	ErrSelfStatus = errors.New("can not change own member status")
+	// ErrReadOnlyChannel subscribers of channel can not post
+	ErrReadOnlyChannel = errors.New("only owner or admin can post in channel")
+	// ErrAlreadyMember user is a normal member of chat already
+	ErrAlreadyMember = errors.New("already member of chat")
+	// ErrJoinPending user has a join request that is not answered yet
+	ErrJoinPending = errors.New("join request is pending")
+	// ErrNotGroup action is not valid in peer chats
+	ErrNotGroup = errors.New("not a group chat")
+	// ErrNotPeer action is only valid in peer chats
+	ErrNotPeer = errors.New("not a peer chat")
+	// ErrBlockedByUser the other user blocked current user
+	ErrBlockedByUser = errors.New("user has blocked you")
+	// ErrUserBlocked current user blocked the other user
+	ErrUserBlocked = errors.New("user is blocked, unblock it first")
+)
+
+//PermissionError is returned when a user is not allowed to do an action on a chat
+type PermissionError struct {
+	UserID string
+	ChatID string
+	Action Action
+	Err    error
+}
+
+func (e *PermissionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+//isManager check the user is normal owner or admin member of chat
+func (ch *chat) isManager(userID string) bool {
+	mem := ch.getMember(userID)
+	return mem != nil && mem.MemberStatus == MemberStatusNormal &&
+		(mem.MemberType == MemberTypeOwner || mem.MemberType == MemberTypeAamin)
+}
+
+//authorize decide if user can do action on chat by chat type and the member
+//type and status of user, it return a *PermissionError when user can not
+func authorize(ch *chat, userID string, action Action) error {
+	deny := func(err error) error {
+		return &PermissionError{UserID: userID, ChatID: ch.ID, Action: action, Err: err}
+	}
+	mem := ch.getMember(userID)
+	status := ""
+	if mem != nil {
+		status = mem.MemberStatus
+	}
+
+	switch action {
+	case ActionJoin:
+		if ch.ChatType == ChatTypePeer {
+			return deny(ErrNotGroup)
+		}
+		switch status {
+		case MemberStatusNormal:
+			return deny(ErrAlreadyMember)
+		case MemberStatusRequested:
+			return deny(ErrJoinPending)
+		case MemberStatusBlocked, MemberStatusExpeled:
+			return deny(ErrBanned)
+		}
+		return nil
+	case ActionRead:
+		// a blocked peer can still read the conversation
+		if status == MemberStatusNormal || (status == MemberStatusBlocked && ch.ChatType == ChatTypePeer) {
+			return nil
+		}
+	case ActionLeave:
+		if status == MemberStatusNormal || status == MemberStatusRequested {
+			return nil
+		}
+	case ActionUnblock:
+		if ch.ChatType == ChatTypePeer && (status == MemberStatusNormal || status == MemberStatusBlocked) {
+			return nil
+		}
+	}
+
+	switch status {
+	case MemberStatusNormal:
+	case MemberStatusBlocked, MemberStatusExpeled:
+		return deny(ErrBanned)
+	default:
+		return deny(ErrNotMember)
+	}
+
+	switch action {
+	case ActionPost:
+		if ch.isChannel() && !ch.isManager(userID) {
+			return deny(ErrReadOnlyChannel)
+		}
+	case ActionAddMember:
+		if ch.ChatType == ChatTypePeer {
+			return deny(ErrNotGroup)
+		}
+		if ch.isChannel() && !ch.isManager(userID) {
+			return deny(ErrNotManager)
+		}
+	case ActionBlock, ActionUnblock:
+		if ch.ChatType != ChatTypePeer {
+			return deny(ErrNotPeer)
+		}
+	case ActionManage:
+		if ch.ChatType == ChatTypePeer {
+			return deny(ErrNotGroup)
+		}
+		if !ch.isManager(userID) {
+			return deny(ErrNotManager)
+		}
+	case ActionOwn:
+		if ch.ChatType == ChatTypePeer {
+			return deny(ErrNotGroup)
+		}
+		if ch.getMember(userID).MemberType != MemberTypeOwner {
+			return deny(ErrNotOwner)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+var (
+	allChatTypes = []string{ChatTypePeer, ChatTypePublicGroup, ChatTypePrivateGroup, ChatTypePublicCannal, ChatTypePrivateCannal}
+	// "" is a user that is not in member list
+	allStatuses = []string{"", MemberStatusNormal, MemberStatusRequested, MemberStatusLeft, MemberStatusBlocked, MemberStatusExpeled}
+	allActions  = []Action{ActionRead, ActionPost, ActionReact, ActionJoin, ActionLeave, ActionAddMember, ActionBlock, ActionUnblock, ActionManage, ActionOwn}
+
+	peerChat = []string{ChatTypePeer}
+	groups   = []string{ChatTypePublicGroup, ChatTypePrivateGroup}
+	channels = []string{ChatTypePublicCannal, ChatTypePrivateCannal}
+)
+
+//authorizeRule is the expected result for a set of cases, an empty list match everything
+type authorizeRule struct {
+	chatTypes []string
+	statuses  []string
+	actions   []Action
+	want      error
+}
+
+func (r authorizeRule) match(chatType, status string, action Action) bool {
+	return (len(r.chatTypes) == 0 || containsString(r.chatTypes, chatType)) &&
+		(len(r.statuses) == 0 || containsString(r.statuses, status)) &&
+		(len(r.actions) == 0 || containsAction(r.actions, action))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAction(list []Action, a Action) bool {
+	for _, v := range list {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+//rules for a normal member type, the first matching rule is used
+var authorizeRules = []authorizeRule{
+	{chatTypes: peerChat, actions: []Action{ActionJoin}, want: ErrNotGroup},
+	{statuses: []string{"", MemberStatusLeft}, actions: []Action{ActionJoin}, want: nil},
+	{statuses: []string{MemberStatusNormal}, actions: []Action{ActionJoin}, want: ErrAlreadyMember},
+	{statuses: []string{MemberStatusRequested}, actions: []Action{ActionJoin}, want: ErrJoinPending},
+	{statuses: []string{MemberStatusRequested}, actions: []Action{ActionLeave}, want: nil},
+	{statuses: []string{"", MemberStatusRequested, MemberStatusLeft}, want: ErrNotMember},
+
+	// a blocked peer can still read the conversation and unblock the other one
+	{chatTypes: peerChat, statuses: []string{MemberStatusBlocked}, actions: []Action{ActionRead, ActionUnblock}, want: nil},
+	{statuses: []string{MemberStatusBlocked, MemberStatusExpeled}, want: ErrBanned},
+
+	{actions: []Action{ActionRead, ActionLeave, ActionReact}, want: nil},
+	{chatTypes: channels, actions: []Action{ActionPost}, want: ErrReadOnlyChannel},
+	{actions: []Action{ActionPost}, want: nil},
+	{chatTypes: peerChat, actions: []Action{ActionAddMember, ActionManage, ActionOwn}, want: ErrNotGroup},
+	{chatTypes: channels, actions: []Action{ActionAddMember}, want: ErrNotManager},
+	{chatTypes: groups, actions: []Action{ActionAddMember}, want: nil},
+	{chatTypes: peerChat, actions: []Action{ActionBlock, ActionUnblock}, want: nil},
+	{actions: []Action{ActionBlock, ActionUnblock}, want: ErrNotPeer},
+	{actions: []Action{ActionManage}, want: ErrNotManager},
+	{actions: []Action{ActionOwn}, want: ErrNotOwner},
+}
+
+func testChat(chatType string, memberType MemberType, status string) *chat {
+	ch := &chat{ID: "chat", ChatType: chatType}
+	ch.MemberList = append(ch.MemberList, member{ID: "m1", UserID: "owner", MemberType: MemberTypeOwner, MemberStatus: MemberStatusNormal})
+	if status != "" {
+		ch.MemberList = append(ch.MemberList, member{ID: "m2", UserID: "user", MemberType: memberType, MemberStatus: status})
+	}
+	return ch
+}
+
+func checkAuthorize(t *testing.T, ch *chat, action Action, want error) {
+	t.Helper()
+	err := authorize(ch, "user", action)
+	if want == nil {
+		if err != nil {
+			t.Errorf("%s: got %v, want nil", action, err)
+		}
+		return
+	}
+	var permErr *PermissionError
+	if !errors.As(err, &permErr) {
+		t.Fatalf("%s: got %v, want *PermissionError", action, err)
+	}
+	if permErr.Err != want {
+		t.Errorf("%s: got %v, want %v", action, permErr.Err, want)
+	}
+	if permErr.UserID != "user" || permErr.ChatID != ch.ID || permErr.Action != action {
+		t.Errorf("%s: error is for %s/%s/%s", action, permErr.UserID, permErr.ChatID, permErr.Action)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	for _, chatType := range allChatTypes {
+		for _, status := range allStatuses {
+			name := chatType + "/" + status
+			if status == "" {
+				name = chatType + "/none"
+			}
+			t.Run(name, func(t *testing.T) {
+				ch := testChat(chatType, MemberTypeNormal, status)
+				for _, action := range allActions {
+					found := false
+					for _, rule := range authorizeRules {
+						if rule.match(chatType, status, action) {
+							checkAuthorize(t, ch, action, rule.want)
+							found = true
+							break
+						}
+					}
+					if !found {
+						t.Errorf("%s: no rule", action)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestAuthorizeManagers(t *testing.T) {
+	tests := []struct {
+		name       string
+		chatTypes  []string
+		memberType MemberType
+		status     string
+		action     Action
+		want       error
+	}{
+		{"owner posts in channel", channels, MemberTypeOwner, MemberStatusNormal, ActionPost, nil},
+		{"admin posts in channel", channels, MemberTypeAamin, MemberStatusNormal, ActionPost, nil},
+		{"admin adds to channel", channels, MemberTypeAamin, MemberStatusNormal, ActionAddMember, nil},
+		{"admin manages", append(groups, channels...), MemberTypeAamin, MemberStatusNormal, ActionManage, nil},
+		{"owner manages", append(groups, channels...), MemberTypeOwner, MemberStatusNormal, ActionManage, nil},
+		{"admin is not owner", append(groups, channels...), MemberTypeAamin, MemberStatusNormal, ActionOwn, ErrNotOwner},
+		{"owner owns", append(groups, channels...), MemberTypeOwner, MemberStatusNormal, ActionOwn, nil},
+		{"no owner role in peer", peerChat, MemberTypeOwner, MemberStatusNormal, ActionOwn, ErrNotGroup},
+		{"blocked admin", append(groups, channels...), MemberTypeAamin, MemberStatusBlocked, ActionManage, ErrBanned},
+		{"expeled admin", channels, MemberTypeAamin, MemberStatusExpeled, ActionPost, ErrBanned},
+		{"left admin", groups, MemberTypeAamin, MemberStatusLeft, ActionManage, ErrNotMember},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, chatType := range tt.chatTypes {
+				checkAuthorize(t, testChat(chatType, tt.memberType, tt.status), tt.action, tt.want)
+			}
+		})
+	}
+}
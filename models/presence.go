@@ -0,0 +1,188 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// PresenceOnline user has an open stream and was active lately
+	PresenceOnline string = "online"
+	// PresenceAway user has an open stream but was not active for awayAfter
+	PresenceAway string = "away"
+	// PresenceOffline user has no open stream
+	PresenceOffline string = "offline"
+
+	awayAfter           = 5 * time.Minute
+	presenceSweepPeriod = 30 * time.Second
+)
+
+type presence struct {
+	listeners  int
+	lastActive time.Time
+	lastSeen   time.Time
+	status     string
+}
+
+var presences = struct {
+	sync.Mutex
+	m map[string]*presence
+}{m: make(map[string]*presence)}
+
+var startPresenceSweeper sync.Once
+
+type userPresence struct {
+	UserID   string
+	Status   string
+	LastSeen time.Time
+}
+
+func getPresence(userID string) *presence {
+	p, ok := presences.m[userID]
+	if !ok {
+		p = &presence{status: PresenceOffline}
+		presences.m[userID] = p
+	}
+	return p
+}
+
+//updateStatus set status from listeners and activity, it return true when status changed
+func (p *presence) updateStatus(now time.Time) bool {
+	status := PresenceOffline
+	if p.listeners > 0 {
+		status = PresenceOnline
+		if now.Sub(p.lastActive) > awayAfter {
+			status = PresenceAway
+		}
+	}
+	if status == p.status {
+		return false
+	}
+	if p.status != PresenceOffline || status == PresenceOffline {
+		p.lastSeen = now
+	}
+	p.status = status
+	return true
+}
+
+func (p *presence) toUserPresence(userID string, now time.Time) userPresence {
+	up := userPresence{UserID: userID, Status: p.status, LastSeen: p.lastSeen}
+	if p.status != PresenceOffline {
+		up.LastSeen = now
+	}
+	return up
+}
+
+func changePresence(userID string, change func(p *presence, now time.Time)) {
+	now := time.Now()
+	presences.Lock()
+	p := getPresence(userID)
+	change(p, now)
+	changed := p.updateStatus(now)
+	up := p.toUserPresence(userID, now)
+	presences.Unlock()
+	if changed {
+		sendPresenceAlert(up)
+	}
+}
+
+func userConnected(userID string) {
+	startPresenceSweeper.Do(func() {
+		go sweepPresences()
+	})
+	changePresence(userID, func(p *presence, now time.Time) {
+		p.listeners++
+		p.lastActive = now
+	})
+}
+
+func userDisconnected(userID string) {
+	changePresence(userID, func(p *presence, now time.Time) {
+		if p.listeners > 0 {
+			p.listeners--
+		}
+	})
+}
+
+//TouchPresence record an activity of user
+func TouchPresence(userID string) {
+	changePresence(userID, func(p *presence, now time.Time) {
+		p.lastActive = now
+	})
+}
+
+//sweepPresences move idle online users to away
+func sweepPresences() {
+	for range time.Tick(presenceSweepPeriod) {
+		now := time.Now()
+		var changed []userPresence
+		presences.Lock()
+		for userID, p := range presences.m {
+			if p.updateStatus(now) {
+				changed = append(changed, p.toUserPresence(userID, now))
+			}
+		}
+		presences.Unlock()
+		for _, v := range changed {
+			sendPresenceAlert(v)
+		}
+	}
+}
+
+//GetPresence return presence of users, users that have no chat with current user
+//are left out
+func GetPresence(currentUserID string, userIDs []string) []userPresence {
+	visible := map[string]bool{currentUserID: true}
+	for _, v := range contactsOf(currentUserID) {
+		visible[v] = true
+	}
+	now := time.Now()
+	presences.Lock()
+	defer presences.Unlock()
+	list := make([]userPresence, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !visible[userID] {
+			continue
+		}
+		p, ok := presences.m[userID]
+		if !ok {
+			list = append(list, userPresence{UserID: userID, Status: PresenceOffline})
+			continue
+		}
+		list = append(list, p.toUserPresence(userID, now))
+	}
+	return list
+}
+
+//contactsOf return users that are normal member of a chat with user
+func contactsOf(userID string) []string {
+	chatList, err := chatStore.ChatsOfUser(userID)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{userID: true}
+	var contacts []string
+	for _, ch := range chatList {
+		if !ch.findMember(userID) {
+			continue
+		}
+		for _, v := range ch.MemberList {
+			if v.MemberStatus == MemberStatusNormal && !seen[v.UserID] {
+				seen[v.UserID] = true
+				contacts = append(contacts, v.UserID)
+			}
+		}
+	}
+	return contacts
+}
+
+func sendPresenceAlert(up userPresence) {
+	newAlert := Alert{
+		AlertType: "PresenceChanged",
+		Data:      up,
+	}
+	// presence is only useful right now, do not replay it on reconnect
+	for _, v := range contactsOf(up.UserID) {
+		getUserChannel(v).broadcast(newAlert)
+	}
+}
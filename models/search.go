@@ -0,0 +1,282 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	snippetBefore      = 60
+	snippetLength      = 200
+)
+
+type docKey struct {
+	ChatID    string
+	MessageID string
+}
+
+//searchIndex is an inverted index from terms to the messages that have them
+var searchIndex = struct {
+	sync.RWMutex
+	postings map[string]map[docKey]int
+	docTerms map[docKey][]string
+}{
+	postings: make(map[string]map[docKey]int),
+	docTerms: make(map[docKey][]string),
+}
+
+type token struct {
+	term       string
+	start, end int
+}
+
+//tokenize split text to lower case words with their byte offsets
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+func removeFromIndex(key docKey) {
+	for _, term := range searchIndex.docTerms[key] {
+		delete(searchIndex.postings[term], key)
+		if len(searchIndex.postings[term]) == 0 {
+			delete(searchIndex.postings, term)
+		}
+	}
+	delete(searchIndex.docTerms, key)
+}
+
+func addToIndex(key docKey, content string) {
+	freq := make(map[string]int)
+	for _, t := range tokenize(content) {
+		freq[t.term]++
+	}
+	terms := make([]string, 0, len(freq))
+	for term, n := range freq {
+		if searchIndex.postings[term] == nil {
+			searchIndex.postings[term] = make(map[docKey]int)
+		}
+		searchIndex.postings[term][key] = n
+		terms = append(terms, term)
+	}
+	searchIndex.docTerms[key] = terms
+}
+
+//indexMessage add or replace a message in the search index
+func indexMessage(chatID string, mes message) {
+	key := docKey{chatID, mes.ID}
+	searchIndex.Lock()
+	defer searchIndex.Unlock()
+	removeFromIndex(key)
+	if mes.DeletedAt == nil {
+		addToIndex(key, mes.Content)
+	}
+}
+
+//unindexMessage remove a message from the search index
+func unindexMessage(chatID, messageID string) {
+	searchIndex.Lock()
+	defer searchIndex.Unlock()
+	removeFromIndex(docKey{chatID, messageID})
+}
+
+//rebuildSearchIndex index all messages of the chat store
+func rebuildSearchIndex() error {
+	chatList, err := chatStore.AllChats()
+	if err != nil {
+		return err
+	}
+	searchIndex.Lock()
+	defer searchIndex.Unlock()
+	searchIndex.postings = make(map[string]map[docKey]int)
+	searchIndex.docTerms = make(map[docKey][]string)
+	for _, info := range chatList {
+		ch, err := chatStore.GetChat(info.ID)
+		if err != nil {
+			return err
+		}
+		for _, v := range ch.MessageList {
+			if v.DeletedAt == nil {
+				addToIndex(docKey{ch.ID, v.ID}, v.Content)
+			}
+		}
+	}
+	return nil
+}
+
+type searchResult struct {
+	ChatID    string
+	MessageID string
+	OwnerID   string
+	CreateAt  time.Time
+	Score     float64
+	// Snippet is html escaped content around the matches with <mark> around them
+	Snippet string
+}
+
+type searchPage struct {
+	Total   int
+	Results []searchResult
+}
+
+//Search find messages that have all words of query in chats that current user
+//can read, results are ranked by tf-idf and newer messages first
+func Search(currentUserID, query string, offset, limit int) (string, error) {
+	terms := make(map[string]bool)
+	for _, t := range tokenize(query) {
+		terms[t.term] = true
+	}
+	if len(terms) == 0 {
+		return "", fmt.Errorf("search query is empty")
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	scores := make(map[docKey]float64)
+	searchIndex.RLock()
+	docCount := float64(len(searchIndex.docTerms))
+	first := true
+	for term := range terms {
+		posting := searchIndex.postings[term]
+		idf := math.Log(1 + docCount/float64(len(posting)+1))
+		next := make(map[docKey]float64)
+		for key, n := range posting {
+			if _, ok := scores[key]; ok || first {
+				next[key] = scores[key] + (1+math.Log(float64(n)))*idf
+			}
+		}
+		scores = next
+		first = false
+	}
+	searchIndex.RUnlock()
+
+	chats := make(map[string]*chat)
+	var results []searchResult
+	for key, score := range scores {
+		ch, ok := chats[key.ChatID]
+		if !ok {
+			ch, _ = getChatInfoFromID(key.ChatID)
+			if ch != nil && authorize(ch, currentUserID, ActionRead) != nil {
+				ch = nil
+			}
+			chats[key.ChatID] = ch
+		}
+		if ch == nil {
+			continue
+		}
+		mes, err := chatStore.GetMessage(key.ChatID, key.MessageID)
+		if err != nil {
+			continue
+		}
+		if mes.DeletedAt != nil || mes.isHiddenFor(currentUserID) {
+			continue
+		}
+		results = append(results, searchResult{
+			ChatID:    key.ChatID,
+			MessageID: mes.ID,
+			OwnerID:   mes.OwnerID,
+			CreateAt:  mes.CreateAt,
+			Score:     score,
+			Snippet:   snippet(mes.Content, terms),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].CreateAt.After(results[j].CreateAt)
+	})
+
+	page := searchPage{Total: len(results), Results: []searchResult{}}
+	if offset < len(results) {
+		end := offset + limit
+		if end > len(results) {
+			end = len(results)
+		}
+		page.Results = results[offset:end]
+	}
+	jPage, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	return string(jPage), nil
+}
+
+//snippet cut content around the first match and mark the matched words
+func snippet(content string, terms map[string]bool) string {
+	tokens := tokenize(content)
+	start := 0
+	for _, t := range tokens {
+		if terms[t.term] {
+			start = t.start - snippetBefore
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	end := start + snippetLength
+	if end > len(content) {
+		end = len(content)
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, t := range tokens {
+		if t.start < start || t.end > end || !terms[t.term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(content[pos:t.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(content[t.start:t.end]))
+		b.WriteString("</mark>")
+		pos = t.end
+	}
+	b.WriteString(html.EscapeString(content[pos:end]))
+	if end < len(content) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,283 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//chatStorage keep chats with their members and messages. A chat is saved
+//without its messages, messages are added and saved one by one so a new message
+//does not rewrite the history of its chat. Stores are the memory and bolt ones
+//of this package, pass one of them to SetChatStore
+type chatStorage interface {
+	AddChat(newChat chat) error
+	// GetChat load a chat with all of its messages
+	GetChat(chatID string) (chat, error)
+	// GetChatInfo load a chat without its messages
+	GetChatInfo(chatID string) (chat, error)
+	// SaveChat replace a stored chat, its MessageList is not saved
+	SaveChat(ch chat) error
+	AddMessage(chatID string, newMessage message) error
+	GetMessage(chatID, messageID string) (message, error)
+	SaveMessage(chatID string, mes message) error
+	// ChatsOfUser load the chats that user is in member list of without messages
+	ChatsOfUser(userID string) ([]chat, error)
+	// PeerChatID return id of the peer chat of two users or empty string
+	PeerChatID(userID, otherUserID string) (string, error)
+	// InviteChatID return id of the chat that has the invite token or empty string
+	InviteChatID(token string) (string, error)
+	// AllChats load all chats without messages ordered by create time
+	AllChats() ([]chat, error)
+}
+
+var chatStore chatStorage = NewMemoryChatStore()
+
+//SetChatStore set the store that chat functions use
+func SetChatStore(store chatStorage) error {
+	chatStore = store
+	return rebuildSearchIndex()
+}
+
+/********************************************************************/
+/*					chat store indexes								*/
+/*																	*/
+/********************************************************************/
+//chatUserIDs return the users in member list of chat
+func chatUserIDs(ch chat) []string {
+	userIDs := make([]string, 0, len(ch.MemberList))
+	for _, v := range ch.MemberList {
+		userIDs = append(userIDs, v.UserID)
+	}
+	return userIDs
+}
+
+func peerKey(userID, otherUserID string) string {
+	if userID > otherUserID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return userID + "\n" + otherUserID
+}
+
+//peerChatKey return the key of the two users of a peer chat, it is false for
+//other chats and for peer chats that have not two different users
+func peerChatKey(ch chat) (string, bool) {
+	if ch.ChatType != ChatTypePeer {
+		return "", false
+	}
+	userIDs := chatUserIDs(ch)
+	if len(userIDs) != 2 || userIDs[0] == userIDs[1] {
+		return "", false
+	}
+	return peerKey(userIDs[0], userIDs[1]), true
+}
+
+func inviteTokens(ch chat) []string {
+	tokens := make([]string, 0, len(ch.Invites))
+	for _, v := range ch.Invites {
+		tokens = append(tokens, v.Token)
+	}
+	return tokens
+}
+
+//removedKeys return the keys of old that are not in current
+func removedKeys(old, current []string) []string {
+	keep := make(map[string]bool, len(current))
+	for _, v := range current {
+		keep[v] = true
+	}
+	var removed []string
+	for _, v := range old {
+		if !keep[v] {
+			removed = append(removed, v)
+		}
+	}
+	return removed
+}
+
+/********************************************************************/
+/*					in memory chat store							*/
+/*																	*/
+/********************************************************************/
+type memoryChatStore struct {
+	lock sync.RWMutex
+	// chats are kept without messages
+	chats        map[string]chat
+	messages     map[string][]message
+	messageIndex map[string]map[string]int
+	userChats    map[string]map[string]bool
+	peerChats    map[string]string
+	inviteChats  map[string]string
+}
+
+//NewMemoryChatStore return a chat store that keep chats in memory
+func NewMemoryChatStore() chatStorage {
+	return &memoryChatStore{
+		chats:        make(map[string]chat),
+		messages:     make(map[string][]message),
+		messageIndex: make(map[string]map[string]int),
+		userChats:    make(map[string]map[string]bool),
+		peerChats:    make(map[string]string),
+		inviteChats:  make(map[string]string),
+	}
+}
+
+//putChat keep ch without its messages and update the indexes from old
+func (s *memoryChatStore) putChat(old, ch chat) {
+	ch.MessageList = nil
+	ch = ch.clone()
+	s.chats[ch.ID] = ch
+	for _, v := range removedKeys(chatUserIDs(old), chatUserIDs(ch)) {
+		delete(s.userChats[v], ch.ID)
+	}
+	for _, v := range chatUserIDs(ch) {
+		if s.userChats[v] == nil {
+			s.userChats[v] = make(map[string]bool)
+		}
+		s.userChats[v][ch.ID] = true
+	}
+	for _, v := range removedKeys(inviteTokens(old), inviteTokens(ch)) {
+		delete(s.inviteChats, v)
+	}
+	for _, v := range inviteTokens(ch) {
+		s.inviteChats[v] = ch.ID
+	}
+	if key, ok := peerChatKey(ch); ok {
+		s.peerChats[key] = ch.ID
+	}
+}
+
+func (s *memoryChatStore) withMessages(ch chat) chat {
+	messageList := make([]message, 0, len(s.messages[ch.ID]))
+	for _, v := range s.messages[ch.ID] {
+		messageList = append(messageList, v.clone())
+	}
+	ch = ch.clone()
+	ch.MessageList = messageList
+	return ch
+}
+
+func (s *memoryChatStore) AddChat(newChat chat) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.chats[newChat.ID]; ok {
+		return fmt.Errorf("Chat is exist")
+	}
+	s.putChat(chat{}, newChat)
+	s.messageIndex[newChat.ID] = make(map[string]int)
+	for _, v := range newChat.MessageList {
+		s.messageIndex[newChat.ID][v.ID] = len(s.messages[newChat.ID])
+		s.messages[newChat.ID] = append(s.messages[newChat.ID], v.clone())
+	}
+	return nil
+}
+
+func (s *memoryChatStore) GetChat(chatID string) (chat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ch, ok := s.chats[chatID]
+	if !ok {
+		return chat{}, fmt.Errorf("Chat didnt find")
+	}
+	return s.withMessages(ch), nil
+}
+
+func (s *memoryChatStore) GetChatInfo(chatID string) (chat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ch, ok := s.chats[chatID]
+	if !ok {
+		return chat{}, fmt.Errorf("Chat didnt find")
+	}
+	return ch.clone(), nil
+}
+
+func (s *memoryChatStore) SaveChat(ch chat) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.chats[ch.ID]
+	if !ok {
+		return fmt.Errorf("Chat didnt find")
+	}
+	s.putChat(old, ch)
+	return nil
+}
+
+func (s *memoryChatStore) AddMessage(chatID string, newMessage message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.chats[chatID]; !ok {
+		return fmt.Errorf("Chat didnt find")
+	}
+	if _, ok := s.messageIndex[chatID][newMessage.ID]; ok {
+		return fmt.Errorf("Message is exist")
+	}
+	s.messageIndex[chatID][newMessage.ID] = len(s.messages[chatID])
+	s.messages[chatID] = append(s.messages[chatID], newMessage.clone())
+	return nil
+}
+
+func (s *memoryChatStore) GetMessage(chatID, messageID string) (message, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ind, ok := s.messageIndex[chatID][messageID]
+	if !ok {
+		return message{}, fmt.Errorf("Message didnt find")
+	}
+	return s.messages[chatID][ind].clone(), nil
+}
+
+func (s *memoryChatStore) SaveMessage(chatID string, mes message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ind, ok := s.messageIndex[chatID][mes.ID]
+	if !ok {
+		return fmt.Errorf("Message didnt find")
+	}
+	s.messages[chatID][ind] = mes.clone()
+	return nil
+}
+
+func (s *memoryChatStore) ChatsOfUser(userID string) ([]chat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	list := make([]chat, 0, len(s.userChats[userID]))
+	for chatID := range s.userChats[userID] {
+		list = append(list, s.chats[chatID].clone())
+	}
+	sortChats(list)
+	return list, nil
+}
+
+func (s *memoryChatStore) PeerChatID(userID, otherUserID string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.peerChats[peerKey(userID, otherUserID)], nil
+}
+
+func (s *memoryChatStore) InviteChatID(token string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.inviteChats[token], nil
+}
+
+func (s *memoryChatStore) AllChats() ([]chat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	list := make([]chat, 0, len(s.chats))
+	for _, v := range s.chats {
+		list = append(list, v.clone())
+	}
+	sortChats(list)
+	return list, nil
+}
+
+//sortChats order chats by create time
+func sortChats(list []chat) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].CreateAt.Equal(list[j].CreateAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreateAt.Before(list[j].CreateAt)
+	})
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // register gif decoder
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	thumbnailMaxSize = 320
+	// maxImagePixels keep huge images from using all memory when decoded,
+	// a decoded image is up to 4 bytes per pixel
+	maxImagePixels = 16 * 1000 * 1000
+)
+
+//thumbnailMIMETypes image types that get size and thumbnail
+var thumbnailMIMETypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+//addImageInfo read size of an uploaded image and store a thumbnail for it, the
+//size is set even when the thumbnail can not be made
+func addImageInfo(att *Attachment) error {
+	r, err := blobStore.Open(att.BlobHash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data := new(bytes.Buffer)
+	if _, err := data.ReadFrom(r); err != nil {
+		return err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		return fmt.Errorf("invalid image")
+	}
+	att.Width = config.Width
+	att.Height = config.Height
+	if config.Width*config.Height > maxImagePixels {
+		return fmt.Errorf("image is too big")
+	}
+	src, _, err := image.Decode(data)
+	if err != nil {
+		return fmt.Errorf("invalid image")
+	}
+
+	thumb := scaleToFit(src, thumbnailMaxSize)
+	thumbData := new(bytes.Buffer)
+	thumbMIMEType := "image/png"
+	if format == "jpeg" {
+		err = jpeg.Encode(thumbData, thumb, &jpeg.Options{Quality: 80})
+		thumbMIMEType = "image/jpeg"
+	} else {
+		// png keep the transparency of png and gif images
+		err = png.Encode(thumbData, thumb)
+	}
+	if err != nil {
+		return err
+	}
+	thumbHash, thumbSize, err := blobStore.Put(thumbData)
+	if err != nil {
+		return err
+	}
+	att.ThumbnailMIMEType = thumbMIMEType
+	att.ThumbnailHash, att.ThumbnailSize = thumbHash, thumbSize
+	att.ThumbnailWidth = thumb.Bounds().Dx()
+	att.ThumbnailHeight = thumb.Bounds().Dy()
+	return nil
+}
+
+//scaleToFit scale down img to fit in a maxSize square by averaging the source
+//pixels under each destination pixel, small images are only copied. The source
+//is read in place so only the thumbnail is allocated
+func scaleToFit(img image.Image, maxSize int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > maxSize || sh > maxSize {
+		if sw >= sh {
+			dw, dh = maxSize, sh*maxSize/sw
+		} else {
+			dw, dh = sw*maxSize/sh, maxSize
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	if dw == sw && dh == sh {
+		dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+		return dst
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			// RGBA() is 16 bit alpha premultiplied, same as the pixels of dst
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n >> 8)
+			dst.Pix[j+1] = uint8(g / n >> 8)
+			dst.Pix[j+2] = uint8(bl / n >> 8)
+			dst.Pix[j+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
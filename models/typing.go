@@ -0,0 +1,116 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// typingThrottle is the minimum time between two Typing alerts of a user in a chat
+	typingThrottle = 2 * time.Second
+	// typingTimeout is the time after the last typing signal that typing stops
+	typingTimeout = 5 * time.Second
+)
+
+type typingState struct {
+	lastSent time.Time
+	// expiresAt is the time that typing stops without a new signal
+	expiresAt time.Time
+	timer     *time.Timer
+}
+
+var typingStates = struct {
+	sync.Mutex
+	m map[string]*typingState
+}{m: make(map[string]*typingState)}
+
+type typingAlert struct {
+	ChatID    string `json:"chatId"`
+	UserID    string `json:"userId"`
+	Typing    bool   `json:"typing"`
+	ExpiresIn int    `json:"expiresIn"`
+}
+
+func sendTypingAlert(chatID, userID string, typing bool) {
+	data := typingAlert{ChatID: chatID, UserID: userID, Typing: typing}
+	if typing {
+		data.ExpiresIn = int(typingTimeout / time.Second)
+	}
+	// typing is only useful right now, do not replay it on reconnect
+	sendEphemeralToOtherMembers(chatID, userID, Alert{
+		AlertType: "Typing",
+		Data:      data,
+	})
+}
+
+//SendTyping tell other members of chat that user is typing, alerts are throttled
+//and a stop alert is sent when no signal comes for typingTimeout
+func SendTyping(chatID, currentUserID string) error {
+	chat, err := getChatInfoFromID(chatID)
+	if err != nil {
+		return err
+	}
+	if err := authorize(chat, currentUserID, ActionPost); err != nil {
+		return err
+	}
+
+	key := chatID + "/" + currentUserID
+	typingStates.Lock()
+	st, ok := typingStates.m[key]
+	if !ok {
+		st = &typingState{}
+		typingStates.m[key] = st
+	}
+	st.expiresAt = time.Now().Add(typingTimeout)
+	if st.timer == nil {
+		st.timer = time.AfterFunc(typingTimeout, func() {
+			typingTimedOut(key, st, chatID, currentUserID)
+		})
+	} else {
+		st.timer.Reset(typingTimeout)
+	}
+	isSend := time.Since(st.lastSent) >= typingThrottle
+	if isSend {
+		st.lastSent = time.Now()
+	}
+	typingStates.Unlock()
+
+	if isSend {
+		sendTypingAlert(chatID, currentUserID, true)
+	}
+	return nil
+}
+
+//typingTimedOut stop typing of st when no signal came before its expire time
+func typingTimedOut(key string, st *typingState, chatID, userID string) {
+	typingStates.Lock()
+	if typingStates.m[key] != st {
+		// typing is stopped
+		typingStates.Unlock()
+		return
+	}
+	if wait := time.Until(st.expiresAt); wait > 0 {
+		// a signal came while the timer was firing
+		st.timer.Reset(wait)
+		typingStates.Unlock()
+		return
+	}
+	delete(typingStates.m, key)
+	typingStates.Unlock()
+	sendTypingAlert(chatID, userID, false)
+}
+
+//StopTyping tell other members of chat that user is not typing anymore
+func StopTyping(chatID, currentUserID string) {
+	key := chatID + "/" + currentUserID
+	typingStates.Lock()
+	st, ok := typingStates.m[key]
+	if ok {
+		st.timer.Stop()
+		delete(typingStates.m, key)
+	}
+	typingStates.Unlock()
+	if ok {
+		sendTypingAlert(chatID, currentUserID, false)
+	}
+}
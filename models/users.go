@@ -0,0 +1,307 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+//User user of the chat system
+type User struct {
+	ID        string
+	FirstName string
+	LastName  string
+	Username  string
+	CreateAt  time.Time
+}
+
+//account a user with the hash of the password
+type account struct {
+	User
+	PasswordHash []byte
+	// BlockedUserIDs users that can not start peer chat with, add or message this user
+	BlockedUserIDs []string
+	// DeletedAt is set on the tombstone that is kept for a deleted account
+	DeletedAt *time.Time
+}
+
+//deletedAccount return the tombstone of a deleted account, it keep the id
+//from being registered again and taking over chats of the deleted user
+func deletedAccount(userID string) account {
+	deletedAt := time.Now()
+	return account{User: User{ID: userID}, DeletedAt: &deletedAt}
+}
+
+//userStorage keep user accounts, IDs and usernames are unique, IDs of deleted
+//accounts stay reserved and are not found by the get functions. Stores are the
+//memory and bolt ones of this package, pass one of them to SetUserStore
+type userStorage interface {
+	AddAccount(newAccount account) error
+	GetAccount(userID string) (account, error)
+	GetAccountByUsername(username string) (account, error)
+	SaveAccount(acc account) error
+	DeleteAccount(userID string) error
+	// PurgeAccount remove an account and its tombstone so its id is free again
+	PurgeAccount(userID string) error
+	// AccountIDs return ids of all accounts that are not deleted
+	AccountIDs() ([]string, error)
+}
+
+var userStore userStorage = NewMemoryUserStore()
+
+//SetUserStore set the store that user functions use
+func SetUserStore(store userStorage) {
+	userStore = store
+}
+
+var demoUsers = []struct {
+	User
+	password string
+}{
+	{User{ID: "admin@e.c", FirstName: "admin", LastName: "admini", Username: "admin"}, "admin-demo"},
+	{User{ID: "normal@e.c", FirstName: "normalUser", LastName: "lastNormal", Username: "normal"}, "normal-demo"},
+	{User{ID: "kalim@e.c", FirstName: "karim", LastName: "Aq Mangool", Username: "kalim"}, "kalim-demo"},
+	{User{ID: "solivan@e.c", FirstName: "solivan", LastName: "sol", Username: "solivan"}, "solivan-demo"},
+	{User{ID: "zohre@e.c", FirstName: "zohre", LastName: "zoh", Username: "zohre"}, "zohre-demo"},
+	{User{ID: "ferzin@e.c", FirstName: "ferzin", LastName: "feriiii", Username: "ferzin"}, "ferzin-demo"},
+}
+
+//CreateDemoUsers add the demo accounts that are not exist yet
+func CreateDemoUsers() error {
+	for _, v := range demoUsers {
+		if _, err := userStore.GetAccount(v.ID); err == nil {
+			continue
+		}
+		if _, err := createAccount(v.User, v.password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createAccount(newUser User, password string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	newUser.CreateAt = time.Now()
+	if err := userStore.AddAccount(account{User: newUser, PasswordHash: hash}); err != nil {
+		return User{}, err
+	}
+	return newUser, nil
+}
+
+//RegisterUser create a new account
+func RegisterUser(userID, username, password, firstName, lastName string) (User, error) {
+	userID = strings.TrimSpace(userID)
+	username = strings.TrimSpace(username)
+	if userID == "" {
+		return User{}, fmt.Errorf("user id can't be empty")
+	}
+	if username == "" {
+		return User{}, fmt.Errorf("username can't be empty")
+	}
+	if len(password) < minPasswordLength {
+		return User{}, fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	newUser := User{
+		ID:        userID,
+		FirstName: firstName,
+		LastName:  lastName,
+		Username:  username,
+	}
+	return createAccount(newUser, password)
+}
+
+//dummyHash is compared when the username is unknown so both cases take the same time
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+//AuthenticateUser authenticate user
+func AuthenticateUser(username, password string) (User, error) {
+	acc, err := userStore.GetAccountByUsername(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, fmt.Errorf("invalid username or password")
+	}
+	if bcrypt.CompareHashAndPassword(acc.PasswordHash, []byte(password)) != nil {
+		return User{}, fmt.Errorf("invalid username or password")
+	}
+	return acc.User, nil
+}
+
+//GetUserIDs return ids of all users
+func GetUserIDs() ([]string, error) {
+	return userStore.AccountIDs()
+}
+
+//GetUser return the user with userID
+func GetUser(userID string) (User, error) {
+	acc, err := userStore.GetAccount(userID)
+	if err != nil {
+		return User{}, err
+	}
+	return acc.User, nil
+}
+
+func checkPassword(userID, password string) (account, error) {
+	acc, err := userStore.GetAccount(userID)
+	if err != nil {
+		return account{}, err
+	}
+	if bcrypt.CompareHashAndPassword(acc.PasswordHash, []byte(password)) != nil {
+		return account{}, fmt.Errorf("wrong password")
+	}
+	return acc, nil
+}
+
+//ChangePassword change the password of user after checking the old one
+func ChangePassword(userID, oldPassword, newPassword string) error {
+	if len(newPassword) < minPasswordLength {
+		return fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	acc, err := checkPassword(userID, oldPassword)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	acc.PasswordHash = hash
+	return userStore.SaveAccount(acc)
+}
+
+//UnregisterUser remove an account that is just registered and is not used
+//yet, unlike DeleteUser its id can be registered again
+func UnregisterUser(userID string) error {
+	return userStore.PurgeAccount(userID)
+}
+
+//DeleteUser delete the account of user after checking the password, the user
+//id can not be registered again so no one can take over chats of the user.
+//The user leave all of its chats and its open listeners are closed
+func DeleteUser(userID, password string) error {
+	if _, err := checkPassword(userID, password); err != nil {
+		return err
+	}
+	if err := userStore.DeleteAccount(userID); err != nil {
+		return err
+	}
+	DeleteBroadcast(userID)
+	return leaveAllChats(userID)
+}
+
+/********************************************************************/
+/*					in memory user store							*/
+/*																	*/
+/********************************************************************/
+type memoryUserStore struct {
+	lock       sync.RWMutex
+	accounts   map[string]account
+	usernameID map[string]string
+}
+
+//NewMemoryUserStore return a user store that keep accounts in memory
+func NewMemoryUserStore() userStorage {
+	return &memoryUserStore{
+		accounts:   make(map[string]account),
+		usernameID: make(map[string]string),
+	}
+}
+
+func (s *memoryUserStore) AddAccount(newAccount account) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.accounts[newAccount.ID]; ok {
+		return fmt.Errorf("user id is taken")
+	}
+	if _, ok := s.usernameID[newAccount.Username]; ok {
+		return fmt.Errorf("username is taken")
+	}
+	s.accounts[newAccount.ID] = newAccount
+	s.usernameID[newAccount.Username] = newAccount.ID
+	return nil
+}
+
+func (s *memoryUserStore) GetAccount(userID string) (account, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	acc, ok := s.accounts[userID]
+	if !ok || acc.DeletedAt != nil {
+		return account{}, fmt.Errorf("User didnt find")
+	}
+	return acc, nil
+}
+
+func (s *memoryUserStore) GetAccountByUsername(username string) (account, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	acc, ok := s.accounts[s.usernameID[username]]
+	if !ok || acc.DeletedAt != nil {
+		return account{}, fmt.Errorf("User didnt find")
+	}
+	return acc, nil
+}
+
+func (s *memoryUserStore) SaveAccount(acc account) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.accounts[acc.ID]
+	if !ok || old.DeletedAt != nil {
+		return fmt.Errorf("User didnt find")
+	}
+	if acc.Username != old.Username {
+		if _, ok := s.usernameID[acc.Username]; ok {
+			return fmt.Errorf("username is taken")
+		}
+		delete(s.usernameID, old.Username)
+		s.usernameID[acc.Username] = acc.ID
+	}
+	s.accounts[acc.ID] = acc
+	return nil
+}
+
+func (s *memoryUserStore) DeleteAccount(userID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	acc, ok := s.accounts[userID]
+	if !ok || acc.DeletedAt != nil {
+		return fmt.Errorf("User didnt find")
+	}
+	delete(s.usernameID, acc.Username)
+	s.accounts[userID] = deletedAccount(userID)
+	return nil
+}
+
+func (s *memoryUserStore) PurgeAccount(userID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	acc, ok := s.accounts[userID]
+	if !ok {
+		return fmt.Errorf("User didnt find")
+	}
+	if acc.DeletedAt == nil {
+		delete(s.usernameID, acc.Username)
+	}
+	delete(s.accounts, userID)
+	return nil
+}
+
+func (s *memoryUserStore) AccountIDs() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var userIDs []string
+	for _, v := range s.accounts {
+		if v.DeletedAt == nil {
+			userIDs = append(userIDs, v.ID)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
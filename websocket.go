@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/casbin/casbin"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/miluxas/ChatBackendGo/models"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// the default origin check keeps other sites from using the session cookie
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+/********************************************************************************/
+/*	websocket commands															*/
+/*																				*/
+/********************************************************************************/
+type wsCommand struct {
+	RequestID     string   `json:"requestId"`
+	Command       string   `json:"command"`
+	ChatID        string   `json:"chatId"`
+	Message       string   `json:"message"`
+	MessageID     string   `json:"messageId"`
+	ReplyToID     string   `json:"replyToId"`
+	AttachmentIDs []string `json:"attachmentIds"`
+}
+
+type wsResult struct {
+	RequestID string `json:"requestId"`
+	Command   string `json:"command"`
+	Error     string `json:"error,omitempty"`
+	NewID     string `json:"newId,omitempty"`
+}
+
+// chat actions that commands need in the chat enforcer
+var wsCommandActions = map[string]string{
+	"sendMessage": "post",
+	"typing":      "post",
+	"markRead":    "read",
+}
+
+func runWSCommand(ce *casbin.SyncedEnforcer, userID string, cmd wsCommand) models.Alert {
+	result := wsResult{RequestID: cmd.RequestID, Command: cmd.Command}
+	var err error
+	if action, ok := wsCommandActions[cmd.Command]; ok && !checkChatPermission(ce, userID, cmd.ChatID, action) {
+		result.Error = "user has no " + action + " permission in this chat"
+		return models.Alert{AlertType: "CommandFailed", Data: result}
+	}
+	switch cmd.Command {
+	case "sendMessage":
+		var sent newMessage
+		sent, err = postMessage(userID, newMessage{
+			ChatID:        cmd.ChatID,
+			Message:       cmd.Message,
+			ReplyToID:     cmd.ReplyToID,
+			AttachmentIDs: cmd.AttachmentIDs,
+		})
+		result.NewID = sent.ID
+	case "typing":
+		err = models.SendTyping(cmd.ChatID, userID)
+	case "stopTyping":
+		models.StopTyping(cmd.ChatID, userID)
+	case "markRead":
+		err = markRead(userID, readMessage{ChatID: cmd.ChatID, MessageID: cmd.MessageID})
+	case "":
+		result.Error = "invalid command"
+	default:
+		result.Error = "unknown command"
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if result.Error != "" {
+		return models.Alert{AlertType: "CommandFailed", Data: result}
+	}
+	return models.Alert{AlertType: "CommandDone", Data: result}
+}
+
+/********************************************************************************/
+/*	get the realtime stream over a websocket									*/
+/*																				*/
+/********************************************************************************/
+func newWebsocketHandler(ce *casbin.SyncedEnforcer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		websocketHandler(c, ce)
+	}
+}
+
+func websocketHandler(c *gin.Context, ce *casbin.SyncedEnforcer) {
+	userID := getUserID(c)
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade already answered the request
+		return
+	}
+	defer conn.Close()
+
+	listener := models.OpenListener(userID)
+	defer models.CloseListener(userID, listener)
+	userDeleted := models.ListenerDone(userID)
+
+	results := make(chan models.Alert)
+	readerGone := make(chan struct{})
+	writerGone := make(chan struct{})
+	defer close(writerGone)
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		defer close(readerGone)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			cmd := wsCommand{}
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				cmd.Command = ""
+			}
+			select {
+			case results <- runWSCommand(ce, userID, cmd):
+			case <-writerGone:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-readerGone:
+			return
+		case <-userDeleted:
+			return
+		case result := <-results:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteJSON(result)
+		case mes := <-listener:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteJSON(mes.(models.Alert))
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}